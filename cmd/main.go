@@ -1,82 +1,1008 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
-
+	"os/signal"
 	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/furmanp/gitlab-activity-importer/internal"
 	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
 )
 
+const usage = `Usage: %s [command]
+
+Commands:
+  import   fetch GitLab commits and push them to the mirror (default)
+  verify   check that the mirror matches a rebuild from scratch
+  rebuild  replace the mirror with a fresh history (requires -confirm)
+  prune    remove mirrored commits of excluded projects (dry run without -confirm)
+  create   create the destination repository through the forge's API
+  check    check the GitLab token and the access to every destination
+  store-secret VARIABLE
+           store a token read from stdin in the Secret Service keyring (Linux)
+  daemon   import on a schedule and serve /healthz and /metrics (alias: serve)
+
+Flags:
+`
+
+var (
+	confirm         = flag.Bool("confirm", false, "confirm destructive commands such as rebuild and prune")
+	workDir         = flag.String("workdir", "", "directory holding the local clones (default $WORKDIR or ~/commits-importer)")
+	inMemory        = flag.Bool("in-memory", false, "clone the destination into memory instead of the workdir (or set IN_MEMORY_CLONE=true)")
+	pruneDeleted    = flag.Bool("deleted", false, "prune: also remove commits from projects that were deleted on GitLab")
+	destinationName = flag.String("destination", "", "only work on the named destination from DESTINATIONS")
+	reportPath      = flag.String("report", "", "write a JSON run report to this file, \"-\" for stdout (or set REPORT_FILE)")
+	logFormat       = flag.String("log-format", "", "log format, text or json (or set LOG_FORMAT, default text)")
+	quiet           = flag.Bool("quiet", false, "only log warnings and errors")
+	verbose         = flag.Bool("verbose", false, "also log every commit, API page and git progress")
+	lockWait        = flag.Duration("lock-wait", 0, "wait this long for another importer to release the workdir (or set LOCK_WAIT, default exit at once)")
+	metricsTextfile = flag.String("metrics-textfile", "", "write Prometheus metrics to this file for node_exporter (or set METRICS_TEXTFILE)")
+	syncSchedule    = flag.String("schedule", "", "daemon: interval such as \"6h\" or cron expression (or set SYNC_SCHEDULE, default @daily)")
+	listenAddr      = flag.String("listen", "", "daemon: address of the health and metrics endpoints (or set LISTEN_ADDR, default :8080)")
+)
+
+// report collects the outcome of the run for -report.
+var report internal.RunReport
+
+// target is a destination together with the settings that shape the history
+// mirrored to it.
+type target struct {
+	dest        internal.Destination
+	aggregation internal.AggregationConfig
+	exclusions  internal.Exclusions
+}
+
 func main() {
 	startNow := time.Now()
-	err := internal.SetupEnv()
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	command := flag.Arg(0)
+	if flag.NArg() > 0 {
+		// Allow flags after the command, e.g. "rebuild -confirm".
+		_ = flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	if command == "store-secret" {
+		// Storing a secret must work before the configuration is complete.
+		_ = internal.LoadEnv()
+		setupLogging()
+		if err := storeSecret(flag.Arg(0)); err != nil {
+			fatal("Error storing secret", "error", err)
+		}
+		return
+	}
+
+	// .env may set LOG_FORMAT, so it is read before logging is configured,
+	// and the warnings of SetupEnv already use the configured handler.
+	// SetupEnv reads it again and reports a broken file.
+	_ = internal.LoadEnv()
+	setupLogging()
+	if err := internal.SetupEnv(); err != nil {
+		fatal("Error during loading environmental variables", "error", err)
+	}
+
+	targets, err := getTargets()
 	if err != nil {
-		log.Fatalf("Error during loading environmental variables: %v", err)
+		fatal("Error during reading destination settings", "error", err)
 	}
 
-	gitlabUser, err := services.GetGitlabUser()
+	if command == "daemon" || command == "serve" {
+		if err := runDaemon(targets); err != nil {
+			fatal("Daemon stopped", "error", err)
+		}
+		return
+	}
+
+	report.Command = command
+	if report.Command == "" {
+		report.Command = "import"
+	}
+	report.StartedAt = startNow
+
+	var run func([]target) error
+	switch command {
+	case "", "import":
+		run = runImport
+	case "verify":
+		run = runVerify
+	case "rebuild":
+		run = runRebuild
+	case "prune":
+		run = runPrune
+	case "create":
+		run = runCreate
+	case "check":
+		run = runCheck
+	default:
+		flag.Usage()
+		fatal("Unknown command", "command", command)
+	}
+	if command == "create" || command == "check" {
+		// Neither command touches the clones.
+		err = run(targets)
+	} else {
+		err = withWorkdirLock(func() error { return run(targets) })
+	}
+	slog.Info("Operation finished", "duration", time.Since(startNow).String())
 
+	finishReport(err)
 	if err != nil {
-		log.Fatalf("Error during reading GitLab User data: %v", err)
+		fatal("Operation failed", "error", err)
 	}
+}
 
-	gitLabUserID := gitlabUser.ID
+// tableOutput is where prune and check print their tables: stdout, unless
+// the JSON run report is written there and has to stay parseable.
+func tableOutput() io.Writer {
+	if *reportPath == "-" || (*reportPath == "" && os.Getenv("REPORT_FILE") == "-") {
+		return os.Stderr
+	}
+	return os.Stdout
+}
 
-	projectIds, err := services.GetUsersProjectsIds(gitLabUserID)
+// finishReport completes the run report and writes it along with the
+// metrics textfile when they are configured.
+func finishReport(err error) {
+	report.FinishedAt = time.Now()
+	report.Timings.TotalSeconds = report.FinishedAt.Sub(report.StartedAt).Seconds()
+	report.Success = err == nil
+	if *reportPath == "" {
+		*reportPath = os.Getenv("REPORT_FILE")
+	}
+	if *reportPath != "" {
+		if err := report.Write(*reportPath); err != nil {
+			slog.Error("Error writing run report", "error", err)
+		}
+	}
+	if *metricsTextfile == "" {
+		*metricsTextfile = os.Getenv("METRICS_TEXTFILE")
+	}
+	if *metricsTextfile != "" {
+		if err := internal.GetMetrics().WriteTextfile(*metricsTextfile); err != nil {
+			slog.Error("Error writing metrics", "error", err)
+		}
+	}
+}
+
+// setupLogging configures the default logger from -log-format, -quiet and
+// -verbose. Logs go to stderr so a report printed to stdout stays parseable.
+func setupLogging() {
+	level := slog.LevelInfo
+	switch {
+	case *verbose:
+		level = slog.LevelDebug
+	case *quiet:
+		level = slog.LevelWarn
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	format := *logFormat
+	if format == "" {
+		format = os.Getenv("LOG_FORMAT")
+	}
+	switch format {
+	case "", "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		fatal("Unknown log format, expected text or json", "format", format)
+	}
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
 
+// getTargets reads the settings of every destination, or only of the one
+// selected with -destination.
+func getTargets() ([]target, error) {
+	destinations, err := internal.GetDestinations()
 	if err != nil {
-		log.Fatalf("Error during getting users projects: %v", err)
+		return nil, err
+	}
+
+	var targets []target
+	for _, dest := range destinations {
+		if *destinationName != "" && dest.Name != *destinationName {
+			continue
+		}
+
+		aggregation, err := internal.GetAggregationConfig(dest)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: %w", dest, err)
+		}
+		exclusions, err := internal.GetExclusions(dest)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: %w", dest, err)
+		}
+		targets = append(targets, target{dest: dest, aggregation: aggregation, exclusions: exclusions})
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no destination named %q in DESTINATIONS", *destinationName)
+	}
+	return targets, nil
+}
+
+// forEachTarget runs fn for every target, recording its outcome in the run
+// report. A failing destination is logged and skipped so it does not hold
+// back the others. It returns an error when any destination failed.
+func forEachTarget(targets []target, fn func(target, *internal.DestinationReport) error) error {
+	failed := 0
+	for _, t := range targets {
+		started := time.Now()
+		destReport := &internal.DestinationReport{Name: t.dest.String()}
+		report.Destinations = append(report.Destinations, destReport)
+
+		if err := fn(t, destReport); err != nil {
+			t.logger().Error("Destination failed", "error", err)
+			destReport.Error = err.Error()
+			failed++
+		}
+		destReport.Seconds = time.Since(started).Seconds()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d destinations failed", failed, len(targets))
+	}
+	return nil
+}
+
+func runImport(targets []target) error {
+	username, projectIds, err := getProjectIds()
+	if err != nil {
+		return err
 	}
 	if len(projectIds) == 0 {
-		log.Print("No contributions found for this user. Closing the program.")
-		return
+		slog.Info("No contributions found for this user. Closing the program.")
+		return nil
+	}
+
+	return importCommits(targets, fetchCommits(username, projectIds))
+}
+
+// importCommits mirrors commits into every target and pushes the new ones.
+func importCommits(targets []target, commits []internal.Commit) error {
+	return forEachTarget(targets, func(t target, destReport *internal.DestinationReport) error {
+		repo, err := openRepository(t.dest)
+		if err != nil {
+			return err
+		}
+
+		if err := services.PullLatestChanges(repo, t.dest); err != nil {
+			return fmt.Errorf("failed to pull latest changes: %w", err)
+		}
+
+		prepared := t.prepare(commits, destReport)
+		imported, err := services.ImportedCommitIDs(repo)
+		if err != nil {
+			return err
+		}
+
+		totalCommitsCreated, err := services.CreateLocalCommit(repo, t.dest, prepared)
+		if err != nil {
+			return fmt.Errorf("failed to create local commits: %w", err)
+		}
+		for _, commit := range prepared {
+			destReport.CountImported(commit, !imported[commit.ID])
+		}
+		t.logger().Info("Imported commits", "created", totalCommitsCreated)
+		internal.CommitsCreated.Add(float64(totalCommitsCreated), "destination", t.dest.String())
+
+		// Reconciling a diverged remote or an earlier failed push can leave
+		// commits to push even when none were created.
+		unpushed, err := services.HasUnpushedCommits(repo)
+		if err != nil {
+			return err
+		}
+		if !unpushed {
+			t.logger().Info("No new commits to push, skipping push operation")
+			destReport.Push = internal.PushSkipped
+			internal.LastSuccess.Set(float64(time.Now().Unix()), "destination", t.dest.String())
+			return nil
+		}
+
+		pushStarted := time.Now()
+		err = services.PushLocalCommits(repo, t.dest)
+		destReport.PushSeconds = time.Since(pushStarted).Seconds()
+		internal.PushDuration.Observe(destReport.PushSeconds, "destination", t.dest.String())
+		if err != nil {
+			destReport.Push = internal.PushFailed
+			return fmt.Errorf("failed to push local commits: %w", err)
+		}
+		destReport.Push = internal.PushPushed
+		t.logger().Info("Successfully pushed commits to remote repository")
+		internal.LastSuccess.Set(float64(time.Now().Unix()), "destination", t.dest.String())
+		return nil
+	})
+}
+
+func runVerify(targets []target) error {
+	username, projectIds, err := getProjectIds()
+	if err != nil {
+		return err
+	}
+
+	commits := fetchCommits(username, projectIds)
+
+	return forEachTarget(targets, func(t target, destReport *internal.DestinationReport) error {
+		repo, err := openRepository(t.dest)
+		if err != nil {
+			return err
+		}
+
+		if err := services.PullLatestChanges(repo, t.dest); err != nil {
+			return fmt.Errorf("failed to pull latest changes: %w", err)
+		}
+
+		result, err := services.VerifyHistory(repo, t.dest, t.prepare(commits, destReport))
+		if err != nil {
+			return fmt.Errorf("failed to verify mirror history: %w", err)
+		}
+
+		t.logger().Info("Compared mirror history with a rebuild",
+			"expected_commits", result.Expected, "expected_head", result.ExpectedHead.String(),
+			"actual_commits", result.Actual, "actual_head", result.ActualHead.String())
+		if !result.Identical() {
+			return fmt.Errorf("mirror history differs from a rebuild from scratch after %d identical commits", result.Matching)
+		}
+		t.logger().Info("Mirror history is identical to a rebuild from scratch")
+		return nil
+	})
+}
+
+// runRebuild rewrites the mirror from all source commits under the current
+// settings. Unlike runImport it never merges the remote branch, it replaces
+// it with a force push after keeping the previous tip under a backup ref.
+func runRebuild(targets []target) error {
+	if !*confirm {
+		return errors.New("rebuild rewrites the history of the destination repository, run it again with -confirm to proceed")
+	}
+
+	username, projectIds, err := getProjectIds()
+	if err != nil {
+		return err
+	}
+	if len(projectIds) == 0 {
+		slog.Info("No contributions found for this user. Closing the program.")
+		return nil
+	}
+
+	commits := fetchCommits(username, projectIds)
+
+	return forEachTarget(targets, func(t target, destReport *internal.DestinationReport) error {
+		repo, err := openRepository(t.dest)
+		if err != nil {
+			return err
+		}
+
+		if err := services.FetchRemote(repo, t.dest); err != nil {
+			return fmt.Errorf("failed to fetch remote changes: %w", err)
+		}
+
+		prepared := t.prepare(commits, destReport)
+		backup, totalCommitsCreated, err := services.RebuildHistory(repo, t.dest, prepared)
+		if err != nil {
+			return fmt.Errorf("failed to rebuild history: %w", err)
+		}
+		t.logger().Info("Rebuilt history", "commits", totalCommitsCreated)
+		internal.CommitsCreated.Add(float64(totalCommitsCreated), "destination", t.dest.String())
+		if backup != "" {
+			t.logger().Info("Previous history is kept under a backup ref", "ref", backup.String())
+		}
+
+		for _, commit := range prepared {
+			destReport.CountImported(commit, true)
+		}
+
+		pushStarted := time.Now()
+		err = services.ForcePushHistory(repo, t.dest, backup)
+		destReport.PushSeconds = time.Since(pushStarted).Seconds()
+		internal.PushDuration.Observe(destReport.PushSeconds, "destination", t.dest.String())
+		if err != nil {
+			destReport.Push = internal.PushFailed
+			return fmt.Errorf("failed to push rebuilt history: %w", err)
+		}
+		destReport.Push = internal.PushPushed
+		t.logger().Info("Successfully replaced the remote history")
+		return nil
+	})
+}
+
+// runPrune removes mirrored commits whose source trailers point at excluded
+// projects or instances and prints what was removed. Without -confirm it only
+// reports what would be removed.
+func runPrune(targets []target) error {
+	instance := internal.GetGitlabInstance()
+	// exists holds the projects known to still exist. Projects the user
+	// contributed to recently are, every other traced project is looked up
+	// once across all destinations.
+	exists := map[int]bool{}
+	if *pruneDeleted {
+		_, projectIds, err := getProjectIds()
+		if err != nil {
+			return err
+		}
+		if len(projectIds) == 0 {
+			return errors.New("prune -deleted: GitLab lists no projects for the user, refusing to decide which projects were deleted")
+		}
+		for _, projectId := range projectIds {
+			exists[projectId] = true
+		}
+	}
+
+	return forEachTarget(targets, func(t target, destReport *internal.DestinationReport) error {
+		repo, err := openRepository(t.dest)
+		if err != nil {
+			return err
+		}
+
+		if err := services.PullLatestChanges(repo, t.dest); err != nil {
+			return fmt.Errorf("failed to pull latest changes: %w", err)
+		}
+
+		// A project only counts as deleted when GitLab answers 404 for it.
+		// The dry run looks up every project, so a failed lookup stops the
+		// destination before anything is rewritten.
+		var lookupErr error
+		failed := map[int]bool{}
+		remove := func(commitInstance string, commitProjects []int) bool {
+			if t.exclusions.Excludes(commitInstance, commitProjects) {
+				return true
+			}
+			if !*pruneDeleted || commitInstance != instance || len(commitProjects) == 0 {
+				return false
+			}
+			for _, projectId := range commitProjects {
+				if failed[projectId] {
+					return false
+				}
+				found, known := exists[projectId]
+				if !known {
+					var err error
+					if found, err = services.ProjectExists(projectId); err != nil {
+						failed[projectId] = true
+						lookupErr = errors.Join(lookupErr, err)
+						return false
+					}
+					exists[projectId] = found
+				}
+				if found {
+					return false
+				}
+			}
+			return true
+		}
+
+		pruned, err := services.PruneHistory(repo, t.dest, remove, true)
+		if err != nil {
+			return fmt.Errorf("failed to prune history: %w", err)
+		}
+		if lookupErr != nil {
+			return fmt.Errorf("failed to check whether projects were deleted: %w", lookupErr)
+		}
+
+		writer := tabwriter.NewWriter(tableOutput(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "MIRROR COMMIT\tSOURCE\tDATE\tINSTANCE\tPROJECTS")
+		for _, removed := range pruned.Removed {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%v\n", removed.Hash, removed.SourceID,
+				removed.When.Format(time.DateOnly), removed.Instance, removed.ProjectIDs)
+		}
+		writer.Flush()
+		t.logger().Info("Pruning history", "remove", len(pruned.Removed), "keep", pruned.Kept, "without_trailers", pruned.Untraceable)
+
+		if len(pruned.Removed) == 0 {
+			return nil
+		}
+		if !*confirm {
+			t.logger().Info("Dry run, nothing was changed. Run it again with -confirm to rewrite the history.")
+			destReport.Push = internal.PushSkipped
+			return nil
+		}
+
+		if pruned, err = services.PruneHistory(repo, t.dest, remove, false); err != nil {
+			return fmt.Errorf("failed to prune history: %w", err)
+		}
+		t.logger().Info("Previous history is kept under a backup ref", "ref", pruned.Backup.String())
+		if err := services.ForcePushHistory(repo, t.dest, pruned.Backup); err != nil {
+			destReport.Push = internal.PushFailed
+			return fmt.Errorf("failed to push pruned history: %w", err)
+		}
+		destReport.Push = internal.PushPushed
+		t.logger().Info("Successfully replaced the remote history")
+		return nil
+	})
+}
+
+// runCheck checks the GitLab token and whether every destination can be
+// read and pushed to, and prints the results as a table.
+func runCheck(targets []target) error {
+	checks := services.CheckGitlabCredentials()
+	for _, t := range targets {
+		checks = append(checks, services.CheckDestinationAccess(t.dest)...)
+	}
+
+	failed := 0
+	writer := tabwriter.NewWriter(tableOutput(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "CHECK\tRESULT\tDETAIL")
+	for _, check := range checks {
+		result := "pass"
+		if !check.Passed {
+			result = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", check.Name, result, check.Detail)
+	}
+	writer.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// storeSecret reads the value of the secret variable name from stdin and
+// stores it in the keyring.
+func storeSecret(name string) error {
+	if !internal.IsSecretVariable(name) {
+		return fmt.Errorf("%q is not a secret variable such as GITLAB_TOKEN or ORIGIN_TOKEN", name)
+	}
+	value, err := internal.ReadSecret(name)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return fmt.Errorf("no value given for %s", name)
+	}
+	if err := internal.StoreSecret(name, value); err != nil {
+		return err
+	}
+	slog.Info("Stored secret in the keyring", "variable", name)
+	return nil
+}
+
+// runCreate creates the empty destination repositories on GitHub, Gitea,
+// Forgejo or GitLab.
+func runCreate(targets []target) error {
+	return forEachTarget(targets, func(t target, _ *internal.DestinationReport) error {
+		return services.CreateRepository(t.dest)
+	})
+}
+
+// withWorkdirLock runs fn while holding the lock of the workdir, so manual
+// and scheduled runs do not work on the same clones at once. In-memory
+// clones do not use the workdir and need no lock.
+func withWorkdirLock(fn func() error) error {
+	if *inMemory || os.Getenv("IN_MEMORY_CLONE") == "true" {
+		return fn()
+	}
+
+	wait := *lockWait
+	if value := os.Getenv("LOCK_WAIT"); wait == 0 && value != "" {
+		var err error
+		if wait, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid LOCK_WAIT %q: %w", value, err)
+		}
+	}
+	lock, err := internal.AcquireRunLock(internal.GetWorkDir(*workDir), wait)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	return fn()
+}
+
+// repositories keeps the repositories opened by openRepository so the daemon
+// reuses them between syncs.
+var repositories = make(map[string]*git.Repository)
+
+// openRepository returns the repository of dest, either cloned into memory
+// for ephemeral runs such as CI or kept in the workdir between runs.
+func openRepository(dest internal.Destination) (*git.Repository, error) {
+	if repo, ok := repositories[dest.String()]; ok {
+		return repo, nil
+	}
+
+	var repo *git.Repository
+	var err error
+	if *inMemory || os.Getenv("IN_MEMORY_CLONE") == "true" {
+		slog.Info("Cloning destination repository into memory", "destination", dest.String())
+		repo, err = services.CloneInMemory(dest)
+	} else {
+		repo, err = services.OpenOrInitClone(dest, internal.GetRepoPath(dest, *workDir))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := services.SelectBranch(repo, dest.Getenv("ORIGIN_BRANCH")); err != nil {
+		return nil, fmt.Errorf("failed to select destination branch: %w", err)
 	}
+	repositories[dest.String()] = repo
+	return repo, nil
+}
+
+// getProjectIds returns the username whose activity is imported and the
+// projects that user contributed to.
+func getProjectIds() (string, []int, error) {
+	gitlabUser, err := services.GetImportedUser()
 
-	log.Printf("Found contributions in %d projects", len(projectIds))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read GitLab user data: %w", err)
+	}
+
+	gitLabUserID := gitlabUser.ID
 
-	repo := services.OpenOrInitClone()
+	projectIds, err := services.GetUsersProjectsIds(gitLabUserID)
 
-	err = services.PullLatestChanges(repo)
 	if err != nil {
-		log.Fatalf("Error pulling latest changes: %v", err)
+		return "", nil, fmt.Errorf("failed to get the user's projects: %w", err)
 	}
 
+	slog.Info("Found contributions", "user", gitlabUser.Username, "projects", len(projectIds))
+	return gitlabUser.Username, projectIds, nil
+}
+
+// fetchCommits collects the user's commits from every project, once for all
+// destinations, and returns them in the order they are mirrored in.
+func fetchCommits(username string, projectIds []int) []internal.Commit {
 	commitChannel := make(chan []internal.Commit, len(projectIds))
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
-	var totalCommitsCreated int
+	var allCommits []internal.Commit
 	go func() {
 		defer wg.Done()
-		totalCommits := 0
 		for commits := range commitChannel {
-			if localCommits, err := services.CreateLocalCommit(repo, commits); err == nil {
-				totalCommits += localCommits
-			} else {
-				log.Printf("Error creating local commit: %v", err)
-			}
+			allCommits = append(allCommits, commits...)
 		}
-		totalCommitsCreated = totalCommits
-		log.Printf("Imported %v commits.\n", totalCommits)
 	}()
 
-	services.FetchAllCommits(projectIds, os.Getenv("GITLAB_USERNAME"), commitChannel)
+	started := time.Now()
+	report.Projects = services.FetchAllCommits(projectIds, username, commitChannel)
 
 	wg.Wait()
+	report.Timings.FetchSeconds = time.Since(started).Seconds()
 
-	if totalCommitsCreated > 0 {
-		if err := services.PushLocalCommits(repo); err != nil {
-			log.Fatalf("Error pushing local commits: %v", err)
-			return
+	// Project batches arrive in whatever order their requests finish, so
+	// the commits are ordered globally before anything is written.
+	return internal.SortCommits(allCommits)
+}
+
+func (t target) logger() *slog.Logger {
+	return slog.With("destination", t.dest.String())
+}
+
+// prepare applies the exclusions and aggregation of t to the fetched commits
+// and counts the excluded ones in destReport.
+func (t target) prepare(commits []internal.Commit, destReport *internal.DestinationReport) []internal.Commit {
+	prepared := t.exclusions.FilterCommits(commits)
+	for _, commit := range commits {
+		if t.exclusions.Excludes(commit.Instance, commit.ProjectIDs) {
+			destReport.CountFiltered(commit)
 		}
-		log.Println("Successfully pushed commits to remote repository.")
+	}
+	excluded := len(commits) - len(prepared)
+	internal.CommitsFiltered.Add(float64(excluded), "destination", t.dest.String())
+	if excluded > 0 {
+		t.logger().Info("Skipped commits from excluded projects", "commits", excluded)
+	}
+	if t.aggregation.Enabled() {
+		total := len(prepared)
+		prepared = internal.AggregateCommits(prepared, t.aggregation)
+		t.logger().Info("Aggregated commits", "commits", total, "aggregated", len(prepared), "mode", t.aggregation.Mode)
+	}
+	return prepared
+}
+
+// daemon runs the import on a schedule and reports the outcome of the last
+// sync on its health endpoint.
+type daemon struct {
+	targets  []target
+	schedule internal.Schedule
+
+	// running is held for the duration of a sync so syncs never overlap.
+	running sync.Mutex
+
+	mu      sync.Mutex
+	lastRun *syncStatus
+	nextRun time.Time
+
+	// Commits received through the webhook wait in pending until no push
+	// arrived for debounce. pendingFullSync asks for a full import instead.
+	webhookSecret   string
+	author          string
+	debounce        time.Duration
+	pending         []internal.Commit
+	pendingFullSync bool
+	flushTimer      *time.Timer
+}
+
+type syncStatus struct {
+	Trigger    string    `json:"trigger"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// runDaemon syncs once at startup and then whenever the schedule is due
+// until it receives SIGINT or SIGTERM. A sync that is still running lets the
+// due time pass, the next one is planned from when it finished.
+func runDaemon(targets []target) error {
+	spec := *syncSchedule
+	if spec == "" {
+		spec = os.Getenv("SYNC_SCHEDULE")
+	}
+	if spec == "" {
+		spec = "@daily"
+	}
+	schedule, err := internal.ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+
+	addr := *listenAddr
+	if addr == "" {
+		addr = os.Getenv("LISTEN_ADDR")
+	}
+	if addr == "" {
+		addr = ":8080"
+	}
+
+	d := &daemon{
+		targets:       targets,
+		schedule:      schedule,
+		webhookSecret: os.Getenv("WEBHOOK_SECRET"),
+		debounce:      time.Minute,
+	}
+	if value := os.Getenv("WEBHOOK_DEBOUNCE"); value != "" {
+		if d.debounce, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid WEBHOOK_DEBOUNCE %q: %w", value, err)
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.serveHealth)
+	mux.Handle("/metrics", internal.GetMetrics())
+	if d.webhookSecret != "" {
+		user, err := services.GetImportedUser()
+		if err != nil {
+			return fmt.Errorf("failed to read GitLab user data: %w", err)
+		}
+		d.author = user.Username
+		mux.HandleFunc("/webhook", d.serveWebhook)
+	}
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	serverErr := make(chan error, 1)
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("Daemon started", "listen", addr, "schedule", spec)
+
+	d.sync("startup")
+	for {
+		next := d.schedule.Next(time.Now())
+		if next.IsZero() {
+			return fmt.Errorf("schedule %q never matches", spec)
+		}
+		d.mu.Lock()
+		d.nextRun = next
+		d.mu.Unlock()
+		slog.Info("Next sync scheduled", "at", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			slog.Info("Daemon stopping")
+			d.mu.Lock()
+			if d.flushTimer != nil {
+				d.flushTimer.Stop()
+			}
+			d.mu.Unlock()
+			// Wait for a sync started by the webhook.
+			d.running.Lock()
+			return nil
+		case err := <-serverErr:
+			timer.Stop()
+			return fmt.Errorf("failed to serve the health endpoint: %w", err)
+		case <-timer.C:
+			d.sync("schedule")
+		}
+	}
+}
+
+// sync imports the latest activity into every destination, unless a sync is
+// already running, and records the outcome for the health endpoint.
+func (d *daemon) sync(trigger string) {
+	if !d.running.TryLock() {
+		slog.Warn("Sync is still running, skipping", "trigger", trigger)
+		return
+	}
+	defer d.running.Unlock()
+	d.record(trigger, func() error { return runImport(d.targets) })
+}
+
+// record runs an import while d.running is held and keeps its outcome for
+// the health endpoint.
+func (d *daemon) record(trigger string, run func() error) {
+	started := time.Now()
+	report = internal.RunReport{Command: "import", StartedAt: started}
+	err := withWorkdirLock(run)
+	finishReport(err)
+
+	status := &syncStatus{Trigger: trigger, StartedAt: started, FinishedAt: time.Now(), Success: err == nil}
+	if err != nil {
+		status.Error = err.Error()
+		slog.Error("Sync failed", "trigger", trigger, "error", err)
 	} else {
-		log.Println("No new commits were created, skipping push operation.")
+		slog.Info("Sync finished", "trigger", trigger, "duration", time.Since(started).String())
+	}
+
+	d.mu.Lock()
+	d.lastRun = status
+	d.mu.Unlock()
+}
+
+// serveHealth reports the last sync as JSON. It answers 503 when that sync
+// failed so load balancers and orchestrators notice.
+func (d *daemon) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	d.mu.Lock()
+	health := struct {
+		Status  string      `json:"status"`
+		LastRun *syncStatus `json:"last_run"`
+		NextRun *time.Time  `json:"next_run,omitempty"`
+	}{Status: "starting", LastRun: d.lastRun}
+	if !d.nextRun.IsZero() {
+		next := d.nextRun
+		health.NextRun = &next
+	}
+	d.mu.Unlock()
+
+	code := http.StatusOK
+	switch {
+	case health.LastRun == nil:
+	case health.LastRun.Success:
+		health.Status = "ok"
+	default:
+		health.Status = "failing"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(health)
+}
+
+// serveWebhook accepts GitLab push hooks and push system hooks carrying the
+// WEBHOOK_SECRET in X-Gitlab-Token. Commits of the configured user pushed to
+// a project's default branch are queued for flushWebhook. Payloads that only
+// list part of a push, and destinations that aggregate commits, need every
+// commit of the day, so those pushes queue a full import instead.
+func (d *daemon) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(d.webhookSecret)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 25<<20))
+	if err != nil {
+		http.Error(w, "failed to read payload", http.StatusBadRequest)
+		return
+	}
+	event, err := internal.ParsePushEvent(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Other events are acknowledged, GitLab disables hooks that keep failing.
+	if !event.IsDefaultBranchPush() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	commits := event.CommitsBy(d.author)
+	// Commits missing from the payload may be the user's as well.
+	if len(commits) > 0 || !event.Complete() {
+		fullSync := !event.Complete()
+		for _, t := range d.targets {
+			fullSync = fullSync || t.aggregation.Enabled()
+		}
+		slog.Info("Received push", "component", "webhook", "project_id", event.ProjectID,
+			"commits", len(commits), "full_sync", fullSync)
+		d.queue(commits, fullSync)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// queue adds commits to the pending webhook commits and (re)starts the
+// debounce timer.
+func (d *daemon) queue(commits []internal.Commit, fullSync bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending = append(d.pending, commits...)
+	d.pendingFullSync = d.pendingFullSync || fullSync
+	if d.flushTimer == nil {
+		d.flushTimer = time.AfterFunc(d.debounce, d.flushWebhook)
+	} else {
+		d.flushTimer.Reset(d.debounce)
+	}
+}
+
+// flushWebhook mirrors the pending webhook commits into every destination
+// and pushes them, waiting for a running sync to finish first.
+func (d *daemon) flushWebhook() {
+	d.mu.Lock()
+	commits, fullSync := d.pending, d.pendingFullSync
+	d.pending, d.pendingFullSync, d.flushTimer = nil, false, nil
+	d.mu.Unlock()
+
+	// A timer reset by queue after it fired runs once more after the
+	// pending commits were already taken.
+	if len(commits) == 0 && !fullSync {
+		return
+	}
+
+	d.running.Lock()
+	defer d.running.Unlock()
+	if fullSync {
+		d.record("webhook", func() error { return runImport(d.targets) })
+		return
+	}
+	d.record("webhook", func() error {
+		commits, err := fetchPushedCommits(commits)
+		if err != nil {
+			return err
+		}
+		return importCommits(d.targets, internal.SortCommits(commits))
+	})
+}
+
+// fetchPushedCommits fetches the commits listed in push hooks from the API.
+// The payload only serves as a trigger: its timestamp is the committed date,
+// which differs from the authored date for rebased or cherry-picked commits.
+func fetchPushedCommits(pushed []internal.Commit) ([]internal.Commit, error) {
+	commits := make([]internal.Commit, 0, len(pushed))
+	for _, c := range pushed {
+		commit, err := services.GetCommit(c.ProjectIDs[0], c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch pushed commit %s: %w", c.ID, err)
+		}
+		commit.Instance, commit.ProjectIDs = c.Instance, c.ProjectIDs
+		commits = append(commits, commit)
 	}
-	log.Printf("Operation took: %v in total.", time.Since(startNow))
+	return commits, nil
 }
@@ -3,14 +3,16 @@ module github.com/furmanp/gitlab-activity-importer
 go 1.24.0
 
 require (
+	github.com/ProtonMail/go-crypto v1.1.3
 	github.com/go-git/go-git/v5 v5.13.0
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.45.0
+	golang.org/x/term v0.37.0
 )
 
 require (
 	dario.cat/mergo v1.0.0 // indirect
 	github.com/Microsoft/go-winio v0.6.1 // indirect
-	github.com/ProtonMail/go-crypto v1.1.3 // indirect
 	github.com/cloudflare/circl v1.6.1 // indirect
 	github.com/cyphar/filepath-securejoin v0.2.5 // indirect
 	github.com/emirpasic/gods v1.18.1 // indirect
@@ -23,7 +25,6 @@ require (
 	github.com/sergi/go-diff v1.3.2-0.20230802210424-5b0b94c5c0d3 // indirect
 	github.com/skeema/knownhosts v1.3.0 // indirect
 	github.com/xanzy/ssh-agent v0.3.3 // indirect
-	golang.org/x/crypto v0.45.0 // indirect
 	golang.org/x/mod v0.17.0 // indirect
 	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// AggregationNone mirrors every source commit one to one.
+	AggregationNone = ""
+	// AggregationCapped mirrors at most AGGREGATION_DAILY_CAP commits per day.
+	AggregationCapped = "capped"
+	// AggregationDaily mirrors a single commit per day carrying a count trailer.
+	AggregationDaily = "daily"
+
+	defaultDailyCap = 10
+)
+
+type AggregationConfig struct {
+	Mode     string
+	DailyCap int
+}
+
+func (a AggregationConfig) Enabled() bool {
+	return a.Mode != AggregationNone
+}
+
+// GetAggregationConfig reads AGGREGATION_MODE and AGGREGATION_DAILY_CAP for
+// dest.
+func GetAggregationConfig(dest Destination) (AggregationConfig, error) {
+	config := AggregationConfig{
+		Mode:     dest.Getenv("AGGREGATION_MODE"),
+		DailyCap: defaultDailyCap,
+	}
+
+	switch config.Mode {
+	case AggregationNone, AggregationCapped, AggregationDaily:
+	default:
+		return AggregationConfig{}, fmt.Errorf("unknown %s %q, expected %q or %q", dest.Var("AGGREGATION_MODE"), config.Mode, AggregationCapped, AggregationDaily)
+	}
+
+	if value := dest.Getenv("AGGREGATION_DAILY_CAP"); value != "" {
+		dailyCap, err := strconv.Atoi(value)
+		if err != nil || dailyCap < 1 {
+			return AggregationConfig{}, fmt.Errorf("%s must be a positive integer, got %q", dest.Var("AGGREGATION_DAILY_CAP"), value)
+		}
+		config.DailyCap = dailyCap
+	}
+
+	return config, nil
+}
+
+// AggregateCommits groups commits by the calendar day they were authored on
+// and reduces every day according to the configured mode. In capped mode the
+// earliest DailyCap commits of a day are kept as they are, so they are still
+// deduplicated by their source ID. In daily mode each day becomes one commit
+// dated at the day's first contribution, with Count holding the day's total.
+//
+// A daily commit is identified by its date, so a day that was already
+// mirrored is not updated when more commits for it show up later. Daily mode
+// therefore leaves out days that are not over yet in the author's time zone;
+// they are mirrored by the first run after midnight.
+func AggregateCommits(commits []Commit, config AggregationConfig) []Commit {
+	if !config.Enabled() || len(commits) == 0 {
+		return commits
+	}
+
+	days := make(map[string][]Commit)
+	for _, commit := range commits {
+		day := commit.AuthoredDate.Format("2006-01-02")
+		days[day] = append(days[day], commit)
+	}
+
+	dayKeys := make([]string, 0, len(days))
+	for day := range days {
+		dayKeys = append(dayKeys, day)
+	}
+	sort.Strings(dayKeys)
+
+	var aggregated []Commit
+	for _, day := range dayKeys {
+		dayCommits := SortCommits(days[day])
+
+		switch config.Mode {
+		case AggregationCapped:
+			if len(dayCommits) > config.DailyCap {
+				dayCommits = dayCommits[:config.DailyCap]
+			}
+			aggregated = append(aggregated, dayCommits...)
+		case AggregationDaily:
+			if time.Now().In(dayCommits[0].AuthoredDate.Location()).Format("2006-01-02") <= day {
+				continue
+			}
+			var projectIDs []int
+			for _, commit := range dayCommits {
+				projectIDs = mergeProjectIDs(projectIDs, commit.ProjectIDs)
+			}
+			aggregated = append(aggregated, Commit{
+				ID:           "activity-" + day,
+				Message:      fmt.Sprintf("%d commits on %s", len(dayCommits), day),
+				AuthorName:   dayCommits[0].AuthorName,
+				AuthorMail:   dayCommits[0].AuthorMail,
+				AuthoredDate: dayCommits[0].AuthoredDate,
+				Count:        len(dayCommits),
+				Instance:     dayCommits[0].Instance,
+				ProjectIDs:   projectIDs,
+			})
+		}
+	}
+
+	return aggregated
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"slices"
+	"sort"
+)
+
+// SortCommits orders commits chronologically by authored date, breaking ties
+// on the source commit ID so that the order does not depend on the order in
+// which projects were fetched. Duplicate IDs, e.g. the same commit reachable
+// from a fork and its upstream, are kept only once with their projects merged.
+func SortCommits(commits []Commit) []Commit {
+	sorted := make([]Commit, len(commits))
+	copy(sorted, commits)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].AuthoredDate.Equal(sorted[j].AuthoredDate) {
+			return sorted[i].AuthoredDate.Before(sorted[j].AuthoredDate)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	unique := sorted[:0]
+	seen := make(map[string]int, len(sorted))
+	for _, commit := range sorted {
+		if i, ok := seen[commit.ID]; ok {
+			unique[i].ProjectIDs = mergeProjectIDs(unique[i].ProjectIDs, commit.ProjectIDs)
+			continue
+		}
+		seen[commit.ID] = len(unique)
+		unique = append(unique, commit)
+	}
+	return unique
+}
+
+// mergeProjectIDs returns the sorted union of both lists.
+func mergeProjectIDs(a, b []int) []int {
+	merged := make([]int, 0, len(a)+len(b))
+	merged = append(merged, a...)
+	for _, projectID := range b {
+		if !slices.Contains(merged, projectID) {
+			merged = append(merged, projectID)
+		}
+	}
+	slices.Sort(merged)
+	return merged
+}
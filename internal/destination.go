@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Destination is a repository the GitLab activity is mirrored to. Without
+// DESTINATIONS there is a single unnamed destination configured through the
+// usual variables. DESTINATIONS lists names instead, e.g. "personal,work",
+// and each of them reads its settings from variables prefixed with the upper
+// cased name, e.g. WORK_ORIGIN_REPO_URL, falling back to the unprefixed
+// variable. Only ORIGIN_REPO_URL has no fallback, every named destination
+// sets its own.
+type Destination struct {
+	Name string
+}
+
+// GetDestinations returns the destinations listed in DESTINATIONS, or the
+// single unnamed destination when it is not set.
+func GetDestinations() ([]Destination, error) {
+	names := splitList(os.Getenv("DESTINATIONS"))
+	if len(names) == 0 {
+		return []Destination{{}}, nil
+	}
+
+	destinations := make([]Destination, 0, len(names))
+	seenNames := make(map[string]bool)
+	seenURLs := make(map[string]string)
+	for _, name := range names {
+		for _, r := range name {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+				return nil, fmt.Errorf("invalid destination name %q in DESTINATIONS, use letters, digits, '-' and '_'", name)
+			}
+		}
+
+		dest := Destination{Name: name}
+		if seenNames[dest.prefix()] {
+			return nil, fmt.Errorf("destination %q is listed twice in DESTINATIONS", name)
+		}
+		seenNames[dest.prefix()] = true
+
+		repoURL := os.Getenv(dest.Var("ORIGIN_REPO_URL"))
+		if repoURL == "" {
+			return nil, fmt.Errorf("destination %q has no %s", name, dest.Var("ORIGIN_REPO_URL"))
+		}
+		if other, ok := seenURLs[repoURL]; ok {
+			return nil, fmt.Errorf("destinations %q and %q both point at %s", other, name, repoURL)
+		}
+		seenURLs[repoURL] = name
+
+		destinations = append(destinations, dest)
+	}
+	return destinations, nil
+}
+
+// Getenv returns the value of the variable key for this destination. A
+// prefixed variable that is set but empty overrides the unprefixed one, so a
+// destination can opt out of a shared setting such as EXCLUDE_PROJECTS.
+func (d Destination) Getenv(key string) string {
+	if d.Name == "" {
+		return os.Getenv(key)
+	}
+	if value, ok := os.LookupEnv(d.prefix() + key); ok || key == "ORIGIN_REPO_URL" {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+// Var returns the name of the variable key as this destination prefers to
+// read it, for use in messages.
+func (d Destination) Var(key string) string {
+	if d.Name == "" {
+		return key
+	}
+	return d.prefix() + key
+}
+
+func (d Destination) String() string {
+	if d.Name == "" {
+		return "default"
+	}
+	return d.Name
+}
+
+func (d Destination) prefix() string {
+	return strings.ToUpper(strings.ReplaceAll(d.Name, "-", "_")) + "_"
+}
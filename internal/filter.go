@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Exclusions lists projects and GitLab instances whose commits must not be
+// mirrored. Configured through EXCLUDE_PROJECTS (comma separated project IDs)
+// and EXCLUDE_INSTANCES (comma separated hosts such as gitlab.example.com),
+// which can be set per destination.
+type Exclusions struct {
+	Projects  map[int]bool
+	Instances map[string]bool
+}
+
+func GetExclusions(dest Destination) (Exclusions, error) {
+	exclusions := Exclusions{
+		Projects:  make(map[int]bool),
+		Instances: make(map[string]bool),
+	}
+
+	for _, value := range splitList(dest.Getenv("EXCLUDE_PROJECTS")) {
+		projectID, err := strconv.Atoi(value)
+		if err != nil {
+			return Exclusions{}, fmt.Errorf("invalid project ID %q in %s", value, dest.Var("EXCLUDE_PROJECTS"))
+		}
+		exclusions.Projects[projectID] = true
+	}
+	for _, value := range splitList(dest.Getenv("EXCLUDE_INSTANCES")) {
+		exclusions.Instances[value] = true
+	}
+
+	return exclusions, nil
+}
+
+// Excludes reports whether a commit from instance and projectIDs is excluded.
+// A commit found in several projects is only excluded when all of them are.
+func (e Exclusions) Excludes(instance string, projectIDs []int) bool {
+	if e.Instances[instance] {
+		return true
+	}
+	if len(projectIDs) == 0 {
+		return false
+	}
+	for _, projectID := range projectIDs {
+		if !e.Projects[projectID] {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterCommits drops the commits excluded by e.
+func (e Exclusions) FilterCommits(commits []Commit) []Commit {
+	filtered := make([]Commit, 0, len(commits))
+	for _, commit := range commits {
+		if !e.Excludes(commit.Instance, commit.ProjectIDs) {
+			filtered = append(filtered, commit)
+		}
+	}
+	return filtered
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lockFileName = ".importer.lock"
+	// The holder of a lock touches it every lockHeartbeat. A lock that was
+	// not touched for lockStaleAfter belongs to a hung or killed importer,
+	// possibly on another host sharing the workdir.
+	lockHeartbeat  = time.Minute
+	lockStaleAfter = 10 * time.Minute
+	// A lock created without hard links is empty until its owner wrote it,
+	// so a lock without an owner only counts as stale after lockWriteGrace.
+	lockWriteGrace = 10 * time.Second
+)
+
+// RunLock keeps other importers out of a workdir while a run works on its
+// clones.
+type RunLock struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// lockOwner is stored in the lock file to tell who holds it.
+type lockOwner struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Started  time.Time `json:"started"`
+}
+
+// AcquireRunLock locks dir for this process. While another importer holds
+// the lock it retries until wait has passed and then returns an error naming
+// the holder. Locks of importers that no longer run on this host, or that
+// stopped touching the lock, are taken over.
+func AcquireRunLock(dir string, wait time.Duration) (*RunLock, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create workdir: %w", err)
+	}
+	path := filepath.Join(dir, lockFileName)
+	deadline := time.Now().Add(wait)
+
+	for {
+		err := createLockFile(path)
+		if err == nil {
+			lock := &RunLock{path: path, stop: make(chan struct{}), done: make(chan struct{})}
+			go lock.heartbeat()
+			return lock, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("failed to lock %s: %w", dir, err)
+		}
+
+		owner, stale, err := inspectLock(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read lock %s: %w", path, err)
+		}
+		if stale {
+			slog.Warn("Removing stale lock", "path", path, "pid", owner.PID, "host", owner.Hostname)
+			if err := removeStaleLock(path); err != nil {
+				return nil, fmt.Errorf("failed to remove stale lock: %w", err)
+			}
+			continue
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("workdir %s is in use by another importer (pid %d on %s, running since %s), wait for it to finish or remove %s if it is no longer running",
+				dir, owner.PID, owner.Hostname, owner.Started.Format(time.RFC3339), path)
+		}
+		slog.Info("Waiting for another importer to release the workdir", "path", path, "pid", owner.PID, "host", owner.Hostname)
+		time.Sleep(min(remaining, 2*time.Second))
+	}
+}
+
+// removeStaleLock moves the stale lock at path aside before removing it.
+// Another importer may have taken over the same stale lock first and created
+// a fresh one, which a plain remove would delete; such a lock is put back.
+func removeStaleLock(path string) error {
+	aside := fmt.Sprintf("%s-stale-%d-%d", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, aside); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(aside)
+
+	owner, stale, err := inspectLock(aside)
+	if err != nil || stale {
+		return nil
+	}
+	if err := linkLockFile(aside, path); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			slog.Warn("Could not restore the lock of another importer", "path", path, "pid", owner.PID, "host", owner.Hostname)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// createLockFile writes the lock to a temporary file and links it into
+// place, so the lock appears atomically and never without its owner.
+func createLockFile(path string) error {
+	hostname, _ := os.Hostname()
+	data, err := json.Marshal(lockOwner{PID: os.Getpid(), Hostname: hostname, Started: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), lockFileName+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return linkLockFile(tmp.Name(), path)
+}
+
+// linkLockFile makes the lock file src appear at path unless a lock already
+// exists there. On filesystems without hard links path is created
+// exclusively and the owner written to it instead.
+func linkLockFile(src, path string) error {
+	err := os.Link(src, path)
+	if err == nil || errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// inspectLock reads the owner of the lock at path and whether it is stale.
+// Within a process runs never overlap, so a lock carrying the own PID was
+// left behind by an earlier process, e.g. an earlier container that also ran
+// as PID 1.
+func inspectLock(path string) (lockOwner, bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return lockOwner{}, false, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return lockOwner{}, false, err
+	}
+
+	var owner lockOwner
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return lockOwner{}, time.Since(info.ModTime()) > lockWriteGrace, nil
+	}
+	if time.Since(info.ModTime()) > lockStaleAfter {
+		return owner, true, nil
+	}
+	hostname, _ := os.Hostname()
+	if owner.Hostname == hostname {
+		if owner.PID == os.Getpid() || owner.PID <= 0 || !processRunning(owner.PID) {
+			return owner, true, nil
+		}
+	}
+	return owner, false, nil
+}
+
+func (l *RunLock) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				slog.Warn("Failed to refresh the workdir lock", "path", l.path, "error", err)
+			}
+		}
+	}
+}
+
+// Release stops refreshing the lock and removes it.
+func (l *RunLock) Release() {
+	close(l.stop)
+	<-l.done
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Failed to remove the workdir lock", "path", l.path, "error", err)
+	}
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const metricsPrefix = "gitlab_activity_importer_"
+
+// Metrics of the importer, in the Prometheus text format. Labels are passed
+// as name/value pairs, e.g. GitLabRequests.Inc("status", "200").
+var (
+	metrics = &MetricsRegistry{}
+
+	GitLabRequests        = metrics.newFamily("gitlab_requests_total", "GitLab API requests by HTTP status.", "counter", nil)
+	GitLabRequestDuration = metrics.newFamily("gitlab_request_duration_seconds", "Duration of GitLab API requests.", "histogram",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+	GitLabPages     = metrics.newFamily("gitlab_pages_fetched_total", "Result pages fetched from the GitLab API.", "counter", nil)
+	CommitsFetched  = metrics.newFamily("commits_fetched_total", "Commits fetched from GitLab.", "counter", nil)
+	CommitsFiltered = metrics.newFamily("commits_filtered_total", "Commits dropped by the exclusions of a destination.", "counter", nil)
+	CommitsCreated  = metrics.newFamily("commits_created_total", "Mirror commits created per destination.", "counter", nil)
+	PushDuration    = metrics.newFamily("push_duration_seconds", "Duration of pushes to a destination.", "histogram",
+		[]float64{0.5, 1, 2.5, 5, 10, 30, 60, 120})
+	LastSuccess = metrics.newFamily("last_success_timestamp_seconds", "Unix time of the last successful import per destination.", "gauge", nil)
+)
+
+// GetMetrics returns the registry holding the importer's metrics.
+func GetMetrics() *MetricsRegistry {
+	return metrics
+}
+
+// MetricsRegistry is a minimal Prometheus registry for counters, gauges and
+// histograms.
+type MetricsRegistry struct {
+	mu       sync.Mutex
+	families []*MetricFamily
+}
+
+type MetricFamily struct {
+	registry *MetricsRegistry
+	name     string
+	help     string
+	kind     string
+	buckets  []float64
+	series   map[string]*metricSeries
+}
+
+type metricSeries struct {
+	value   float64
+	sum     float64
+	count   uint64
+	buckets []uint64
+}
+
+func (r *MetricsRegistry) newFamily(name, help, kind string, buckets []float64) *MetricFamily {
+	family := &MetricFamily{
+		registry: r,
+		name:     metricsPrefix + name,
+		help:     help,
+		kind:     kind,
+		buckets:  buckets,
+		series:   make(map[string]*metricSeries),
+	}
+	r.families = append(r.families, family)
+	return family
+}
+
+// Inc adds one to a counter.
+func (f *MetricFamily) Inc(labels ...string) {
+	f.Add(1, labels...)
+}
+
+// Add adds value to a counter or gauge.
+func (f *MetricFamily) Add(value float64, labels ...string) {
+	f.registry.mu.Lock()
+	defer f.registry.mu.Unlock()
+	f.get(labels).value += value
+}
+
+// Set sets a gauge to value.
+func (f *MetricFamily) Set(value float64, labels ...string) {
+	f.registry.mu.Lock()
+	defer f.registry.mu.Unlock()
+	f.get(labels).value = value
+}
+
+// Observe records value in a histogram.
+func (f *MetricFamily) Observe(value float64, labels ...string) {
+	f.registry.mu.Lock()
+	defer f.registry.mu.Unlock()
+	series := f.get(labels)
+	series.sum += value
+	series.count++
+	for i, bound := range f.buckets {
+		if value <= bound {
+			series.buckets[i]++
+		}
+	}
+}
+
+func (f *MetricFamily) get(labels []string) *metricSeries {
+	key := formatLabels(labels)
+	series, ok := f.series[key]
+	if !ok {
+		series = &metricSeries{buckets: make([]uint64, len(f.buckets))}
+		f.series[key] = series
+	}
+	return series
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds one more label to labels as returned by formatLabels.
+func withLabel(labels, name, value string) string {
+	pair := fmt.Sprintf("%s=%q", name, value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + pair + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+// Counters without labels are reported as zero before their first update.
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out strings.Builder
+	for _, family := range r.families {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) == 0 && family.kind == "counter" {
+			fmt.Fprintf(&out, "%s 0\n", family.name)
+		}
+
+		for _, key := range keys {
+			series := family.series[key]
+			if family.kind != "histogram" {
+				fmt.Fprintf(&out, "%s%s %s\n", family.name, key, formatValue(series.value))
+				continue
+			}
+			for i, bound := range family.buckets {
+				fmt.Fprintf(&out, "%s_bucket%s %d\n", family.name, withLabel(key, "le", formatValue(bound)), series.buckets[i])
+			}
+			fmt.Fprintf(&out, "%s_bucket%s %d\n", family.name, withLabel(key, "le", "+Inf"), series.count)
+			fmt.Fprintf(&out, "%s_sum%s %s\n", family.name, key, formatValue(series.sum))
+			fmt.Fprintf(&out, "%s_count%s %d\n", family.name, key, series.count)
+		}
+	}
+
+	n, err := io.WriteString(w, out.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape.
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w)
+}
+
+// WriteTextfile writes the metrics to path for the textfile collector of
+// node_exporter. The file is replaced atomically so the collector never reads
+// a partial file; path should end in .prom.
+func (r *MetricsRegistry) WriteTextfile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".metrics-*")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := r.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package internal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processRunning reports whether a process with the given PID exists. A
+// process owned by another user cannot be signalled but still exists.
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,13 @@
+package internal
+
+import "os"
+
+// processRunning reports whether a process with the given PID exists.
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = process.Release()
+	return true
+}
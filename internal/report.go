@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	PushPushed  = "pushed"
+	PushSkipped = "skipped"
+	PushFailed  = "failed"
+)
+
+// RunReport is the machine readable summary of a run. It is written as JSON
+// to the file given with -report or REPORT_FILE, "-" meaning stdout.
+type RunReport struct {
+	Command      string               `json:"command"`
+	StartedAt    time.Time            `json:"started_at"`
+	FinishedAt   time.Time            `json:"finished_at"`
+	Success      bool                 `json:"success"`
+	Timings      Timings              `json:"timings"`
+	Projects     []ProjectFetch       `json:"projects"`
+	Destinations []*DestinationReport `json:"destinations"`
+}
+
+type Timings struct {
+	FetchSeconds float64 `json:"fetch_seconds"`
+	TotalSeconds float64 `json:"total_seconds"`
+}
+
+// ProjectFetch is the outcome of fetching the user's commits of one project.
+type ProjectFetch struct {
+	ProjectID int     `json:"project_id"`
+	Fetched   int     `json:"fetched"`
+	Error     string  `json:"error,omitempty"`
+	Seconds   float64 `json:"seconds"`
+}
+
+// DestinationReport describes what happened to one destination. Push is one
+// of PushPushed, PushSkipped or PushFailed, or empty when the command does
+// not push.
+type DestinationReport struct {
+	Name        string           `json:"name"`
+	Projects    []*ProjectCounts `json:"projects"`
+	Push        string           `json:"push,omitempty"`
+	PushSeconds float64          `json:"push_seconds,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	Seconds     float64          `json:"seconds"`
+}
+
+// ProjectCounts follows the commits of one project on their way to a
+// destination. Filtered commits were dropped by its exclusions; the others
+// were either already imported or created. A commit found in several
+// projects counts for each of them.
+type ProjectCounts struct {
+	ProjectID       int `json:"project_id"`
+	Filtered        int `json:"filtered"`
+	AlreadyImported int `json:"already_imported"`
+	Created         int `json:"created"`
+}
+
+// CountFiltered records commit as dropped by the destination's exclusions.
+func (r *DestinationReport) CountFiltered(commit Commit) {
+	for _, projectID := range commit.ProjectIDs {
+		r.project(projectID).Filtered++
+	}
+}
+
+// CountImported records commit as already imported or newly created.
+func (r *DestinationReport) CountImported(commit Commit, created bool) {
+	for _, projectID := range commit.ProjectIDs {
+		if created {
+			r.project(projectID).Created++
+		} else {
+			r.project(projectID).AlreadyImported++
+		}
+	}
+}
+
+func (r *DestinationReport) project(projectID int) *ProjectCounts {
+	for _, counts := range r.Projects {
+		if counts.ProjectID == projectID {
+			return counts
+		}
+	}
+	counts := &ProjectCounts{ProjectID: projectID}
+	r.Projects = append(r.Projects, counts)
+	return counts
+}
+
+// Write stores the report as indented JSON in path, or prints it to stdout
+// when path is "-".
+func (r *RunReport) Write(path string) error {
+	sort.Slice(r.Projects, func(i, j int) bool { return r.Projects[i].ProjectID < r.Projects[j].ProjectID })
+	for _, dest := range r.Destinations {
+		sort.Slice(dest.Projects, func(i, j int) bool { return dest.Projects[i].ProjectID < dest.Projects[j].ProjectID })
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run report: %w", err)
+	}
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write run report: %w", err)
+	}
+	return nil
+}
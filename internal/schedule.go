@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule tells the daemon when to sync next.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// ParseSchedule accepts either an interval such as "30m" or "6h", or a cron
+// expression with the five fields minute, hour, day of month, month and day
+// of week, e.g. "0 */6 * * *". Fields support "*", lists, ranges and steps;
+// @hourly, @daily, @weekly and @monthly are accepted as well. Cron
+// expressions are evaluated in the local time zone.
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval < time.Minute {
+			return nil, fmt.Errorf("sync interval %s is shorter than a minute", interval)
+		}
+		return intervalSchedule(interval), nil
+	}
+
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, expected an interval such as \"6h\" or a cron expression with 5 fields", spec)
+	}
+
+	var cron cronSchedule
+	var err error
+	bounds := []struct {
+		target   *uint64
+		min, max int
+		name     string
+	}{
+		{&cron.minutes, 0, 59, "minute"},
+		{&cron.hours, 0, 23, "hour"},
+		{&cron.days, 1, 31, "day of month"},
+		{&cron.months, 1, 12, "month"},
+		{&cron.weekdays, 0, 7, "day of week"},
+	}
+	for i, field := range fields {
+		b := bounds[i]
+		if *b.target, err = parseCronField(field, b.min, b.max); err != nil {
+			return nil, fmt.Errorf("invalid %s in schedule %q: %w", b.name, spec, err)
+		}
+	}
+	// Sunday may be written as 0 or 7.
+	if cron.weekdays&(1<<7) != 0 {
+		cron.weekdays |= 1
+	}
+	cron.anyDay = fields[2] == "*"
+	cron.anyWeekday = fields[4] == "*"
+	return cron, nil
+}
+
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(s))
+}
+
+// cronSchedule keeps the allowed values of every field as a bit set.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	anyDay, anyWeekday                     bool
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for value := low; value <= high; value += step {
+			set |= 1 << value
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first full minute after after that matches the
+// expression. Like cron, a restricted day of month and day of week match when
+// either of them does.
+func (s cronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// Every valid expression matches within a few years (e.g. Feb 29).
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.months&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hours&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minutes&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	day := s.days&(1<<t.Day()) != 0
+	weekday := s.weekdays&(1<<int(t.Weekday())) != 0
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// keyringService is the service attribute of the importer's secrets in the
+// Secret Service keyring.
+const keyringService = "gitlab-activity-importer"
+
+// secretVariables hold credentials. Instead of setting them directly they
+// can be read from the file named in the variable with a _FILE suffix, e.g.
+// GITLAB_TOKEN_FILE for Docker and Kubernetes secrets, or from the Secret
+// Service keyring on Linux.
+var secretVariables = []string{
+	"GITLAB_TOKEN",
+	"ORIGIN_TOKEN",
+	"GH_APP_PRIVATE_KEY",
+	"ORIGIN_SSH_KEY_PASSPHRASE",
+	"SIGNING_KEY_PASSPHRASE",
+	"WEBHOOK_SECRET",
+}
+
+// IsSecretVariable reports whether name is one of the secret variables,
+// possibly prefixed for a destination such as WORK_ORIGIN_TOKEN.
+func IsSecretVariable(name string) bool {
+	for _, key := range secretVariables {
+		if name == key || strings.HasSuffix(name, "_"+key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveSecrets sets the secret variables that are not set from their
+// _FILE variant or else from the keyring, so the rest of the importer reads
+// them like any other variable. Tokens that are still missing are asked for
+// when running on a terminal.
+func ResolveSecrets() error {
+	// Invalid DESTINATIONS are reported by CheckEnvVariables.
+	destinations, _ := GetDestinations()
+	if len(destinations) == 0 {
+		destinations = []Destination{{}}
+	}
+
+	var names []string
+	for _, dest := range destinations {
+		for _, key := range secretVariables {
+			for _, name := range []string{dest.Var(key), key} {
+				if !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+		if os.Getenv(name) != "" {
+			continue
+		}
+		value, source, err := lookupSecret(name)
+		if err != nil {
+			return err
+		}
+		if source == "" {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+		slog.Debug("Read secret", "variable", name, "source", source)
+	}
+
+	return promptMissingTokens()
+}
+
+// lookupSecret reads the secret name from its _FILE variant or from the
+// keyring. The returned source is empty when neither has it.
+func lookupSecret(name string) (string, string, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), "file", nil
+	}
+
+	if keyringAvailable() {
+		// A locked or broken keyring must not stop runs configured
+		// through the environment.
+		value, err := keyringLookup(name)
+		if err != nil {
+			slog.Warn("Could not read the keyring", "variable", name, "error", err)
+		}
+		if value != "" {
+			return value, "keyring", nil
+		}
+	}
+	return "", "", nil
+}
+
+// promptMissingTokens asks for the required tokens that are still unset when
+// stdin is a terminal. The input is not echoed.
+func promptMissingTokens() error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil
+	}
+	missing, err := missingEnvVariables()
+	if err != nil {
+		return nil
+	}
+
+	for _, name := range missing {
+		if !strings.HasSuffix(name, "_TOKEN") {
+			continue
+		}
+		value, err := ReadSecret(name)
+		if err != nil {
+			return err
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSecret reads the value of the secret variable name from stdin,
+// prompting for it without echo on a terminal and reading the first line
+// otherwise.
+func ReadSecret(name string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprintf(os.Stderr, "%s: ", name)
+		value, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		return strings.TrimSpace(string(value)), nil
+	}
+
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// keyringAvailable reports whether the Secret Service can be reached through
+// secret-tool from libsecret, i.e. on a Linux desktop session.
+func keyringAvailable() bool {
+	if runtime.GOOS != "linux" || os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return false
+	}
+	_, err := exec.LookPath("secret-tool")
+	return err == nil
+}
+
+// keyringLookup returns the secret name stored in the keyring, or an empty
+// string when there is none.
+func keyringLookup(name string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", keyringService, "variable", name).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) == 0 {
+		// secret-tool exits with 1 and no message when nothing is stored.
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s from the keyring: %w", name, err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// StoreSecret stores value as the secret variable name in the Secret Service
+// keyring, where later runs find it when the variable is not set.
+func StoreSecret(name, value string) error {
+	if !keyringAvailable() {
+		return errors.New("the keyring needs Linux with a D-Bus session and secret-tool (libsecret-tools)")
+	}
+	cmd := exec.Command("secret-tool", "store", "--label", keyringService+" "+name,
+		"service", keyringService, "variable", name)
+	cmd.Stdin = strings.NewReader(value)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to store %s in the keyring: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
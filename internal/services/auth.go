@@ -0,0 +1,91 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// OriginAuth returns the credentials for the ORIGIN_REPO_URL of dest. HTTPS
+// remotes on GitHub use a GitHub App installation token when GH_APP_ID is
+// set, otherwise ORIGIN_TOKEN is sent with the user name the forge expects.
+// SSH remotes use the key in ORIGIN_SSH_KEY, or the running ssh-agent when no
+// key is configured, and verify the host against ORIGIN_KNOWN_HOSTS or the
+// default known_hosts files.
+func OriginAuth(dest internal.Destination) (transport.AuthMethod, error) {
+	repoURL := dest.Getenv("ORIGIN_REPO_URL")
+	if !internal.IsSSHURL(repoURL) {
+		f, err := destinationForge(dest)
+		if err != nil {
+			return nil, err
+		}
+		if f.kind == forgeGitHub && dest.Getenv("GH_APP_ID") != "" {
+			token, err := GetAppInstallationToken(dest)
+			if err != nil {
+				return nil, err
+			}
+			return &http.BasicAuth{Username: "x-access-token", Password: token}, nil
+		}
+		return &http.BasicAuth{
+			Username: f.authUsername(dest),
+			Password: dest.Getenv("ORIGIN_TOKEN"),
+		}, nil
+	}
+
+	endpoint, err := transport.NewEndpoint(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", dest.Var("ORIGIN_REPO_URL"), err)
+	}
+	user := endpoint.User
+	if user == "" {
+		user = ssh.DefaultUsername
+	}
+
+	var knownHosts []string
+	if path := dest.Getenv("ORIGIN_KNOWN_HOSTS"); path != "" {
+		knownHosts = append(knownHosts, path)
+	}
+	hostKeyCallback, err := knownHostsCallback(knownHosts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+	}
+
+	if keyPath := dest.Getenv("ORIGIN_SSH_KEY"); keyPath != "" {
+		auth, err := ssh.NewPublicKeysFromFile(user, keyPath, dest.Getenv("ORIGIN_SSH_KEY_PASSPHRASE"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ssh key %s: %w", keyPath, err)
+		}
+		auth.HostKeyCallback = hostKeyCallback
+		return auth, nil
+	}
+
+	auth, err := ssh.NewSSHAgentAuth(user)
+	if err != nil {
+		return nil, fmt.Errorf("no %s configured and ssh-agent is unavailable: %w", dest.Var("ORIGIN_SSH_KEY"), err)
+	}
+	auth.HostKeyCallback = hostKeyCallback
+	return auth, nil
+}
+
+// knownHostsCallback wraps ssh.NewKnownHostsCallback, which in go-git 5.13
+// panics on a nil database instead of returning its error when no known_hosts
+// file can be loaded.
+func knownHostsCallback(files ...string) (callback gossh.HostKeyCallback, err error) {
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		if recover() != nil {
+			callback, err = nil, errors.New("no valid known_hosts file found, set ORIGIN_KNOWN_HOSTS or SSH_KNOWN_HOSTS")
+		}
+	}()
+	return ssh.NewKnownHostsCallback(files...)
+}
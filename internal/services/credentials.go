@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+)
+
+// CredentialCheck is the outcome of one check run by the check command.
+type CredentialCheck struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// gitlabReadScopes are the token scopes that allow reading the user's
+// projects and commits through the API.
+var gitlabReadScopes = []string{"api", "read_api"}
+
+// CheckGitlabCredentials checks that GITLAB_TOKEN is active and has a scope
+// to read the API, and that the user whose activity is imported exists.
+func CheckGitlabCredentials() []CredentialCheck {
+	scopes := CredentialCheck{Name: "GitLab token scopes"}
+	token, err := getGitlabTokenInfo()
+	switch {
+	case err != nil:
+		scopes.Detail = err.Error()
+	case !token.Active:
+		scopes.Detail = fmt.Sprintf("token %q is revoked or expired", token.Name)
+	case !slices.ContainsFunc(token.Scopes, func(scope string) bool { return slices.Contains(gitlabReadScopes, scope) }):
+		scopes.Detail = fmt.Sprintf("token %q needs the read_api or api scope, has %s", token.Name, strings.Join(token.Scopes, ", "))
+	default:
+		scopes.Passed = true
+		scopes.Detail = fmt.Sprintf("token %q has %s", token.Name, strings.Join(token.Scopes, ", "))
+		if token.ExpiresAt != "" {
+			scopes.Detail += ", expires " + token.ExpiresAt
+		}
+	}
+
+	user := CredentialCheck{Name: "GitLab user"}
+	owner, err := GetGitlabUser()
+	switch username := os.Getenv("GITLAB_USERNAME"); {
+	case err != nil:
+		user.Detail = err.Error()
+	case username == "" || strings.EqualFold(username, owner.Username):
+		user.Passed = true
+		user.Detail = "importing the activity of the token owner " + owner.Username
+	default:
+		if _, err := FindGitlabUser(username); err != nil {
+			user.Detail = fmt.Sprintf("token belongs to %s, cannot find GITLAB_USERNAME %s: %v", owner.Username, username, err)
+		} else {
+			user.Passed = true
+			user.Detail = fmt.Sprintf("token belongs to %s, importing the activity of GITLAB_USERNAME %s", owner.Username, username)
+		}
+	}
+
+	return []CredentialCheck{scopes, user}
+}
+
+type gitlabTokenInfo struct {
+	Name      string   `json:"name"`
+	Active    bool     `json:"active"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt string   `json:"expires_at"`
+}
+
+// getGitlabTokenInfo describes GITLAB_TOKEN. The endpoint also answers for
+// project and group access tokens.
+func getGitlabTokenInfo() (gitlabTokenInfo, error) {
+	req, err := http.NewRequestWithContext(context.Background(), "GET",
+		os.Getenv("BASE_URL")+"/api/v4/personal_access_tokens/self", nil)
+	if err != nil {
+		return gitlabTokenInfo{}, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("PRIVATE-TOKEN", os.Getenv("GITLAB_TOKEN"))
+
+	res, err := doGitlabRequest(req)
+	if err != nil {
+		return gitlabTokenInfo{}, fmt.Errorf("error making the request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return gitlabTokenInfo{}, fmt.Errorf("status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var info gitlabTokenInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return gitlabTokenInfo{}, fmt.Errorf("decode error: %w", err)
+	}
+	return info, nil
+}
+
+// CheckDestinationAccess checks that the credentials of dest can read and
+// push to its repository. Like git ls-remote and the start of git push it
+// only asks the server for its refs, nothing is changed. Branch protection
+// rules only apply to the pushed refs and are not checked.
+func CheckDestinationAccess(dest internal.Destination) []CredentialCheck {
+	read := CredentialCheck{Name: "read " + dest.String()}
+	write := CredentialCheck{Name: "push " + dest.String()}
+
+	endpoint, err := transport.NewEndpoint(dest.Getenv("ORIGIN_REPO_URL"))
+	if err != nil {
+		read.Detail = fmt.Sprintf("invalid %s: %v", dest.Var("ORIGIN_REPO_URL"), err)
+		write.Detail = read.Detail
+		return []CredentialCheck{read, write}
+	}
+	auth, err := OriginAuth(dest)
+	if err != nil {
+		read.Detail = err.Error()
+		write.Detail = read.Detail
+		return []CredentialCheck{read, write}
+	}
+	cli, err := client.NewClient(endpoint)
+	if err != nil {
+		read.Detail = err.Error()
+		write.Detail = read.Detail
+		return []CredentialCheck{read, write}
+	}
+
+	if session, err := cli.NewUploadPackSession(endpoint, auth); err != nil {
+		read.Detail = err.Error()
+	} else {
+		refs, err := session.AdvertisedReferences()
+		switch {
+		case errors.Is(err, transport.ErrEmptyRemoteRepository):
+			read.Passed = true
+			read.Detail = "repository is empty"
+		case err != nil:
+			read.Detail = err.Error()
+		default:
+			read.Passed = true
+			read.Detail = fmt.Sprintf("%d refs", len(refs.References))
+		}
+		session.Close()
+	}
+
+	if session, err := cli.NewReceivePackSession(endpoint, auth); err != nil {
+		write.Detail = err.Error()
+	} else {
+		if _, err := session.AdvertisedReferences(); err != nil && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			write.Detail = err.Error()
+		} else {
+			write.Passed = true
+			write.Detail = "push access granted"
+		}
+		session.Close()
+	}
+
+	return []CredentialCheck{read, write}
+}
@@ -0,0 +1,308 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+const (
+	forgeGitHub  = "github"
+	forgeGitea   = "gitea"
+	forgeForgejo = "forgejo"
+	forgeGitLab  = "gitlab"
+)
+
+// forge describes the server hosting a destination repository: which API it
+// speaks and where to reach it.
+type forge struct {
+	kind   string
+	apiURL string
+}
+
+// destinationForge returns the forge of dest. ORIGIN_FORGE selects "github",
+// "gitea", "forgejo" or "gitlab"; when it is empty the well known hosts are
+// recognised and anything else is assumed to be GitHub (Enterprise).
+// ORIGIN_API_URL overrides the API base URL derived from ORIGIN_REPO_URL.
+func destinationForge(dest internal.Destination) (forge, error) {
+	endpoint, err := transport.NewEndpoint(dest.Getenv("ORIGIN_REPO_URL"))
+	if err != nil {
+		return forge{}, fmt.Errorf("invalid %s: %w", dest.Var("ORIGIN_REPO_URL"), err)
+	}
+
+	kind := strings.ToLower(dest.Getenv("ORIGIN_FORGE"))
+	if kind == "" {
+		switch endpoint.Host {
+		case "gitlab.com":
+			kind = forgeGitLab
+		case "codeberg.org":
+			kind = forgeForgejo
+		default:
+			kind = forgeGitHub
+		}
+	}
+
+	// SSH remotes are reached over HTTPS for API calls.
+	base := "https://" + endpoint.Host
+	if endpoint.Protocol == "http" || endpoint.Protocol == "https" {
+		base = endpoint.Protocol + "://" + endpoint.Host
+		if endpoint.Port != 0 {
+			base = fmt.Sprintf("%s:%d", base, endpoint.Port)
+		}
+	}
+
+	apiURL := strings.TrimSuffix(dest.Getenv("ORIGIN_API_URL"), "/")
+	switch kind {
+	case forgeGitHub:
+		if apiURL == "" {
+			apiURL = strings.TrimSuffix(dest.Getenv("GH_API_URL"), "/")
+		}
+		if apiURL == "" {
+			apiURL = defaultGitHubAPIURL
+			if endpoint.Host != "github.com" {
+				apiURL = base + "/api/v3"
+			}
+		}
+	case forgeGitea, forgeForgejo:
+		if apiURL == "" {
+			apiURL = base + "/api/v1"
+		}
+	case forgeGitLab:
+		if apiURL == "" {
+			apiURL = base + "/api/v4"
+		}
+	default:
+		return forge{}, fmt.Errorf("unknown %s %q, expected %q, %q, %q or %q", dest.Var("ORIGIN_FORGE"), kind,
+			forgeGitHub, forgeGitea, forgeForgejo, forgeGitLab)
+	}
+	return forge{kind: kind, apiURL: apiURL}, nil
+}
+
+// authUsername returns the user name sent along with ORIGIN_TOKEN over
+// HTTPS. GitHub, Gitea and Forgejo expect the owner of the token, GitLab
+// accepts any name for personal, project and group tokens and documents
+// "oauth2". ORIGIN_USERNAME overrides it.
+func (f forge) authUsername(dest internal.Destination) string {
+	if username := dest.Getenv("ORIGIN_USERNAME"); username != "" {
+		return username
+	}
+	if f.kind == forgeGitLab {
+		return "oauth2"
+	}
+	return dest.Getenv("GH_USERNAME")
+}
+
+// apiToken returns the token used for API calls, which is the one used for
+// pushing.
+func (f forge) apiToken(dest internal.Destination) (string, error) {
+	if f.kind == forgeGitHub && dest.Getenv("GH_APP_ID") != "" {
+		return GetAppInstallationToken(dest)
+	}
+	token := dest.Getenv("ORIGIN_TOKEN")
+	if token == "" {
+		return "", fmt.Errorf("%s is required to use the %s API", dest.Var("ORIGIN_TOKEN"), f.kind)
+	}
+	return token, nil
+}
+
+// repoOptions describes a repository created by CreateRepository.
+type repoOptions struct {
+	Private       bool
+	Description   string
+	DefaultBranch string
+}
+
+// loadRepoOptions reads the options for new repositories of dest:
+// ORIGIN_REPO_VISIBILITY ("private" by default or "public"),
+// ORIGIN_REPO_DESCRIPTION and ORIGIN_BRANCH as the default branch.
+func loadRepoOptions(dest internal.Destination) (repoOptions, error) {
+	options := repoOptions{
+		Private:       true,
+		Description:   dest.Getenv("ORIGIN_REPO_DESCRIPTION"),
+		DefaultBranch: dest.Getenv("ORIGIN_BRANCH"),
+	}
+	switch visibility := dest.Getenv("ORIGIN_REPO_VISIBILITY"); visibility {
+	case "", "private":
+	case "public":
+		options.Private = false
+	default:
+		return repoOptions{}, fmt.Errorf("unknown %s %q, expected \"private\" or \"public\"", dest.Var("ORIGIN_REPO_VISIBILITY"), visibility)
+	}
+	if options.DefaultBranch == "" {
+		options.DefaultBranch = "main"
+	}
+	return options, nil
+}
+
+// CreateRepository creates the empty repository behind the ORIGIN_REPO_URL
+// of dest through the API of its forge, owned by the token's user or by the
+// organisation (group on GitLab) in the URL.
+func CreateRepository(dest internal.Destination) error {
+	f, err := destinationForge(dest)
+	if err != nil {
+		return err
+	}
+	options, err := loadRepoOptions(dest)
+	if err != nil {
+		return err
+	}
+	namespace, name, err := repoNamespaceAndName(dest.Getenv("ORIGIN_REPO_URL"))
+	if err != nil {
+		return err
+	}
+	token, err := f.apiToken(dest)
+	if err != nil {
+		return err
+	}
+
+	switch f.kind {
+	case forgeGitLab:
+		err = f.createGitLabProject(token, namespace, name, options)
+	default:
+		err = f.createRepository(dest, token, namespace, name, options)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s/%s on %s: %w", namespace, name, f.kind, err)
+	}
+
+	slog.Info("Created repository", "component", "forge", "destination", dest.String(),
+		"forge", f.kind, "repository", namespace+"/"+name)
+	return nil
+}
+
+// createRepository creates a repository through the GitHub API or the
+// compatible endpoints of Gitea and Forgejo. GitHub ignores default_branch,
+// the first pushed branch becomes the default there.
+func (f forge) createRepository(dest internal.Destination, token, owner, name string, options repoOptions) error {
+	path := "/orgs/" + url.PathEscape(owner) + "/repos"
+	// Installation tokens of GitHub Apps cannot create user repositories.
+	if f.kind != forgeGitHub || dest.Getenv("GH_APP_ID") == "" {
+		var user struct {
+			Login string `json:"login"`
+		}
+		if err := f.request(token, http.MethodGet, "/user", nil, http.StatusOK, &user); err != nil {
+			return fmt.Errorf("failed to read the token's user: %w", err)
+		}
+		if strings.EqualFold(user.Login, owner) {
+			path = "/user/repos"
+		}
+	}
+
+	body := map[string]any{
+		"name":           name,
+		"description":    options.Description,
+		"private":        options.Private,
+		"default_branch": options.DefaultBranch,
+		"auto_init":      false,
+	}
+	return f.request(token, http.MethodPost, path, body, http.StatusCreated, nil)
+}
+
+// createGitLabProject creates a project in the token user's namespace or in
+// the group (or subgroup) namespace.
+func (f forge) createGitLabProject(token, namespace, name string, options repoOptions) error {
+	var user struct {
+		Username string `json:"username"`
+	}
+	if err := f.request(token, http.MethodGet, "/user", nil, http.StatusOK, &user); err != nil {
+		return fmt.Errorf("failed to read the token's user: %w", err)
+	}
+
+	visibility := "private"
+	if !options.Private {
+		visibility = "public"
+	}
+	body := map[string]any{
+		"name":           name,
+		"path":           name,
+		"description":    options.Description,
+		"visibility":     visibility,
+		"default_branch": options.DefaultBranch,
+	}
+
+	if !strings.EqualFold(user.Username, namespace) {
+		var group struct {
+			ID int `json:"id"`
+		}
+		if err := f.request(token, http.MethodGet, "/namespaces/"+url.PathEscape(namespace), nil, http.StatusOK, &group); err != nil {
+			return fmt.Errorf("failed to find namespace %s: %w", namespace, err)
+		}
+		body["namespace_id"] = group.ID
+	}
+	return f.request(token, http.MethodPost, "/projects", body, http.StatusCreated, nil)
+}
+
+// request calls the forge API with the authentication header the forge
+// expects and decodes the response into target unless it is nil.
+func (f forge) request(token, method, path string, body any, expectedStatus int, target any) error {
+	var payload io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(encoded)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	req, err := http.NewRequestWithContext(context.Background(), method, f.apiURL+path, payload)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch f.kind {
+	case forgeGitLab:
+		req.Header.Set("PRIVATE-TOKEN", token)
+	case forgeGitea, forgeForgejo:
+		req.Header.Set("Authorization", "token "+token)
+	default:
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "application/vnd.github+json")
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making the request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("status %d: %s", res.StatusCode, string(body))
+	}
+
+	if target == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(target); err != nil {
+		return fmt.Errorf("decode error: %w", err)
+	}
+	return nil
+}
+
+// repoNamespaceAndName splits the path of repoURL into the namespace, which
+// on GitLab may contain subgroups, and the repository name.
+func repoNamespaceAndName(repoURL string) (string, string, error) {
+	endpoint, err := transport.NewEndpoint(repoURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid repository URL: %w", err)
+	}
+	path := strings.TrimSuffix(strings.Trim(endpoint.Path, "/"), ".git")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 || i == len(path)-1 {
+		return "", "", fmt.Errorf("cannot determine owner and repository from %q", repoURL)
+	}
+	return path[:i], path[i+1:], nil
+}
@@ -3,8 +3,10 @@ package services
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/furmanp/gitlab-activity-importer/internal"
 	"github.com/go-git/go-git/v5"
@@ -12,47 +14,125 @@ import (
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
-	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
 )
 
-func OpenOrInitClone() *git.Repository {
-	repoPath := internal.GetHomeDirectory() + "/commits-importer/"
+const defaultPushRetries = 3
 
+// OpenOrInitClone opens the clone of the ORIGIN_REPO_URL of dest at
+// repoPath, making a bare clone first if needed. Clones made by earlier
+// versions still have a worktree, it is simply no longer updated. An existing
+// clone is only reused when its origin points at ORIGIN_REPO_URL. With
+// ORIGIN_CREATE_REPO=true a repository that does not exist yet is created
+// through the API of its forge first.
+func OpenOrInitClone(dest internal.Destination, repoPath string) (*git.Repository, error) {
 	repo, err := git.PlainOpen(repoPath)
 	if err != nil {
 		if err == git.ErrRepositoryNotExists {
-			log.Println("Repository doesn't exist. Cloning new repository from remote.")
-			repo, err = cloneRemoteRepo()
-			if err != nil {
-				log.Fatal(err)
+			destLogger(dest).Info("Repository doesn't exist, cloning it from remote", "path", repoPath)
+			return cloneRemoteRepo(dest, repoPath)
+		}
+		return nil, fmt.Errorf("failed to open the repository at %s: %w", repoPath, err)
+	}
+
+	if err := checkOriginURL(repo, dest); err != nil {
+		return nil, fmt.Errorf("refusing to reuse the repository at %s: %w", repoPath, err)
+	}
+	destLogger(dest).Info("Opened existing repository", "path", repoPath)
+	return repo, nil
+}
+
+func checkOriginURL(repo *git.Repository, dest internal.Destination) error {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return fmt.Errorf("failed to read origin remote: %w", err)
+	}
+
+	repoURL := dest.Getenv("ORIGIN_REPO_URL")
+	urls := remote.Config().URLs
+	if len(urls) == 0 || urls[0] != repoURL {
+		return fmt.Errorf("origin points at %v but %s is %s", urls, dest.Var("ORIGIN_REPO_URL"), repoURL)
+	}
+	return nil
+}
+
+// CloneInMemory makes a bare clone of the ORIGIN_REPO_URL of dest in memory,
+// for runs whose clone is thrown away afterwards anyway. Only the default
+// branch is fetched, but with its full history: already imported commits are
+// recognised by walking it, which a shallow clone would cut short. Missing
+// repositories are created like in OpenOrInitClone.
+func CloneInMemory(dest internal.Destination) (*git.Repository, error) {
+	repoURL := dest.Getenv("ORIGIN_REPO_URL")
+
+	auth, err := OriginAuth(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	cloneOptions := &git.CloneOptions{
+		URL:          repoURL,
+		Auth:         auth,
+		SingleBranch: true,
+		Progress:     gitProgress(),
+	}
+	if branch := dest.Getenv("ORIGIN_BRANCH"); branch != "" {
+		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(branch)
+	}
+
+	repo, err := git.Clone(memory.NewStorage(), nil, cloneOptions)
+	if err != nil && cloneOptions.ReferenceName != "" && errors.Is(err, git.NoMatchingRefSpecError{}) {
+		// The branch does not exist on the remote yet, SelectBranch creates it.
+		cloneOptions.ReferenceName = ""
+		repo, err = git.Clone(memory.NewStorage(), nil, cloneOptions)
+	}
+	if err != nil && errors.Is(err, transport.ErrRepositoryNotFound) && dest.Getenv("ORIGIN_CREATE_REPO") == "true" {
+		err = createMissingRepository(dest)
+	}
+	if err != nil {
+		if err == transport.ErrEmptyRemoteRepository {
+			newRepo, initErr := git.Init(memory.NewStorage(), nil)
+			if initErr != nil {
+				return nil, initErr
 			}
-		} else {
-			log.Fatal("Failed to open or initialize the repository:", err)
+
+			_, remoteErr := newRepo.CreateRemote(&config.RemoteConfig{
+				Name: "origin",
+				URLs: []string{repoURL},
+			})
+			if remoteErr != nil {
+				return nil, remoteErr
+			}
+
+			return newRepo, nil
 		}
-	} else {
-		log.Println("Opened existing repository.")
+		return nil, fmt.Errorf("error cloning repository: %w", err)
 	}
-	return repo
+
+	return repo, nil
 }
 
-func cloneRemoteRepo() (*git.Repository, error) {
-	homeDir := internal.GetHomeDirectory() + "/commits-importer/"
-	repoURL := os.Getenv("ORIGIN_REPO_URL")
+func cloneRemoteRepo(dest internal.Destination, repoPath string) (*git.Repository, error) {
+	repoURL := dest.Getenv("ORIGIN_REPO_URL")
+
+	auth, err := OriginAuth(dest)
+	if err != nil {
+		return nil, err
+	}
 
-	repo, err := git.PlainClone(homeDir, false, &git.CloneOptions{
-		URL: repoURL,
-		Auth: &http.BasicAuth{
-			Username: os.Getenv("GH_USERNAME"),
-			Password: os.Getenv("ORIGIN_TOKEN"),
-		},
-		Progress: os.Stdout,
+	repo, err := git.PlainClone(repoPath, true, &git.CloneOptions{
+		URL:      repoURL,
+		Auth:     auth,
+		Progress: gitProgress(),
 	})
+	if err != nil && errors.Is(err, transport.ErrRepositoryNotFound) && dest.Getenv("ORIGIN_CREATE_REPO") == "true" {
+		err = createMissingRepository(dest)
+	}
 
 	if err != nil {
 		if err == transport.ErrEmptyRemoteRepository {
-			newRepo, initErr := git.PlainInit(homeDir, false)
+			newRepo, initErr := git.PlainInit(repoPath, true)
 			if initErr != nil {
-				_ = os.RemoveAll(homeDir)
+				_ = os.RemoveAll(repoPath)
 				return nil, initErr
 			}
 
@@ -72,79 +152,143 @@ func cloneRemoteRepo() (*git.Repository, error) {
 	return repo, nil
 }
 
-func CreateLocalCommit(repo *git.Repository, commits []internal.Commit) (int, error) {
+// createMissingRepository creates the destination repository after cloning
+// it failed because it does not exist. The new repository is empty, which is
+// reported as ErrEmptyRemoteRepository so the clone is set up like for any
+// other empty remote.
+func createMissingRepository(dest internal.Destination) error {
+	destLogger(dest).Info("Repository does not exist, creating it", "url", dest.Getenv("ORIGIN_REPO_URL"))
+	if err := CreateRepository(dest); err != nil {
+		return err
+	}
+	return transport.ErrEmptyRemoteRepository
+}
+
+func CreateLocalCommit(repo *git.Repository, dest internal.Destination, commits []internal.Commit) (int, error) {
 	if len(commits) == 0 {
-		log.Println("No commits to process")
+		destLogger(dest).Info("No commits to process")
 		return 0, nil
 	}
 
-	workTree, err := repo.Worktree()
+	existingCommitSet, err := ImportedCommitIDs(repo)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get worktree: %w", err)
+		return 0, fmt.Errorf("failed to get existing commits: %w", err)
 	}
 
-	repoPath := internal.GetHomeDirectory() + "/commits-importer/"
-	filePath := repoPath + "/readme.md"
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		file, err := os.Create(filePath)
-		if err != nil {
-			return 0, fmt.Errorf("failed to create file: %w", err)
-		}
-		_, err = file.WriteString("Just a readme.")
-		if err != nil {
-			file.Close()
-			return 0, fmt.Errorf("failed to write to file: %w", err)
-		}
-		if err := file.Close(); err != nil {
-			return 0, fmt.Errorf("failed to close file: %w", err)
+	branch, parent, err := headBranch(repo)
+	if err != nil {
+		return 0, err
+	}
+
+	var newCommits []internal.Commit
+	for _, commit := range commits {
+		if existingCommitSet[commit.ID] {
+			destLogger(dest).Debug("Commit is already imported", "commit", commit.ID)
+			continue
 		}
+		newCommits = append(newCommits, commit)
+	}
+	if len(newCommits) == 0 {
+		return 0, nil
 	}
 
-	_, err = workTree.Add("readme.md")
+	hashes, err := buildMirrorHistory(repo.Storer, dest, parent, newCommits)
 	if err != nil {
-		return 0, fmt.Errorf("failed to add readme.md to index: %w", err)
+		return 0, err
 	}
+	for _, hash := range hashes {
+		destLogger(dest).Debug("Created commit", "hash", hash.String())
+	}
+
+	if err := updateBranch(repo, branch, hashes[len(hashes)-1]); err != nil {
+		return 0, err
+	}
+	return len(hashes), nil
+}
 
-	existingCommitSet, err := getAllExistingCommitSHAs(repo)
+// SelectBranch points HEAD at the destination branch name and tracks it
+// against origin. The branch starts at the remote one when it exists there
+// and is created by the first mirrored commit otherwise. Without a name the
+// branch HEAD already points at is kept if it has commits, which for clones
+// is the remote's default branch, and "main" is used for new repositories.
+func SelectBranch(repo *git.Repository, name string) error {
+	branch, tip, err := headBranch(repo)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get existing commits: %w", err)
+		return err
 	}
+	if name == "" {
+		name = "main"
+		if !tip.IsZero() {
+			name = branch.Short()
+		}
+	}
+	branch = plumbing.NewBranchReferenceName(name)
 
-	totalCommits := 0
-	for _, commit := range commits {
-		if !existingCommitSet[commit.ID] {
-			newCommit, err := workTree.Commit(commit.ID, &git.CommitOptions{
-				Author: &object.Signature{
-					Name:  os.Getenv("GH_USERNAME"),
-					Email: os.Getenv("COMMITER_EMAIL"),
-					When:  commit.AuthoredDate,
-				},
-				Committer: &object.Signature{
-					Name:  os.Getenv("GH_USERNAME"),
-					Email: os.Getenv("COMMITER_EMAIL"),
-					When:  commit.AuthoredDate,
-				},
-				AllowEmptyCommits: true,
-			})
-			if err != nil {
-				return 0, fmt.Errorf("failed to create commit %s: %w", commit.ID, err)
-			}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch)); err != nil {
+		return fmt.Errorf("failed to point HEAD at %s: %w", name, err)
+	}
 
-			obj, err := repo.CommitObject(newCommit)
-			if err != nil {
-				return 0, fmt.Errorf("failed to get commit object for %s: %w", newCommit, err)
+	if _, err := repo.Storer.Reference(branch); err == plumbing.ErrReferenceNotFound {
+		remoteRef, err := repo.Storer.Reference(plumbing.NewRemoteReferenceName("origin", name))
+		if err == nil {
+			if err := updateBranch(repo, branch, remoteRef.Hash()); err != nil {
+				return err
 			}
-
-			log.Printf("Created commit: %s\n", obj.Hash)
-			totalCommits++
+		} else if err != plumbing.ErrReferenceNotFound {
+			return err
 		} else {
-			log.Printf("Commit: %v is already imported \n", commit.ID)
+			slog.Info("Branch does not exist yet, it will be created", "component", "git", "branch", name)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %w", branch, err)
+	}
+
+	if _, err := repo.Branch(name); err == git.ErrBranchNotFound {
+		err = repo.CreateBranch(&config.Branch{Name: name, Remote: "origin", Merge: branch})
+		if err != nil {
+			return fmt.Errorf("failed to track %s against origin: %w", name, err)
 		}
+	} else if err != nil {
+		return fmt.Errorf("failed to read branch config of %s: %w", name, err)
 	}
-	return totalCommits, nil
+	return nil
 }
 
-func getAllExistingCommitSHAs(repo *git.Repository) (map[string]bool, error) {
+// headBranch returns the branch HEAD points at together with its current
+// tip, which is the zero hash when the branch has no commits yet.
+func headBranch(repo *git.Repository) (plumbing.ReferenceName, plumbing.Hash, error) {
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("failed to read HEAD: %w", err)
+	}
+
+	branch := head.Name()
+	if head.Type() == plumbing.SymbolicReference {
+		branch = head.Target()
+	}
+
+	tip, err := repo.Storer.Reference(branch)
+	if err != nil {
+		if err == plumbing.ErrReferenceNotFound {
+			return branch, plumbing.ZeroHash, nil
+		}
+		return "", plumbing.ZeroHash, fmt.Errorf("failed to read %s: %w", branch, err)
+	}
+	return branch, tip.Hash(), nil
+}
+
+// updateBranch moves branch to tip. Mirror commits are written straight to
+// the object store, so there is no worktree to keep in sync.
+func updateBranch(repo *git.Repository, branch plumbing.ReferenceName, tip plumbing.Hash) error {
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, tip)); err != nil {
+		return fmt.Errorf("failed to update %s: %w", branch, err)
+	}
+	return nil
+}
+
+// ImportedCommitIDs returns the IDs of the source commits already mirrored
+// on the branch HEAD points at.
+func ImportedCommitIDs(repo *git.Repository) (map[string]bool, error) {
 	existingCommits := make(map[string]bool)
 	ref, err := repo.Reference("HEAD", true)
 	if err != nil {
@@ -154,64 +298,244 @@ func getAllExistingCommitSHAs(repo *git.Repository) (map[string]bool, error) {
 		return nil, fmt.Errorf("failed to get HEAD reference: %v", err)
 	}
 
-	iter, err := repo.Log(&git.LogOptions{From: ref.Hash()})
+	return commitSubjects(repo, ref.Hash())
+}
+
+// commitSubjects returns the first lines of all commits reachable from tip.
+// For mirrored commits that is the ID of the source commit.
+func commitSubjects(repo *git.Repository, tip plumbing.Hash) (map[string]bool, error) {
+	subjects := make(map[string]bool)
+	iter, err := repo.Log(&git.LogOptions{From: tip})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get commit log: %v", err)
 	}
 	defer iter.Close()
 
 	err = iter.ForEach(func(c *object.Commit) error {
-		existingCommits[c.Message] = true
+		subject, _, _ := strings.Cut(c.Message, "\n")
+		subjects[subject] = true
 		return nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to iterate commits: %v", err)
 	}
 
-	return existingCommits, nil
+	return subjects, nil
 }
 
-func PullLatestChanges(repo *git.Repository) error {
-	wt, err := repo.Worktree()
+// PullLatestChanges fetches origin and fast-forwards the branch HEAD points
+// at to the remote one. It works on bare repositories. When the local and
+// remote history diverged, e.g. because someone pushed to the mirror from
+// elsewhere, they are reconciled according to DIVERGENCE_STRATEGY.
+func PullLatestChanges(repo *git.Repository, dest internal.Destination) error {
+	if err := FetchRemote(repo, dest); err != nil {
+		return err
+	}
+
+	branch, local, err := headBranch(repo)
 	if err != nil {
 		return err
 	}
 
-	err = wt.Pull(&git.PullOptions{
-		RemoteName: "origin",
-		Auth: &http.BasicAuth{
-			Username: os.Getenv("GH_USERNAME"),
-			Password: os.Getenv("ORIGIN_TOKEN"),
-		},
-	})
+	remoteRef, err := repo.Storer.Reference(plumbing.NewRemoteReferenceName("origin", branch.Short()))
 	if err != nil {
-		if err == git.NoErrAlreadyUpToDate {
-			log.Println("No changes to pull, working tree is up to date.")
+		if err == plumbing.ErrReferenceNotFound {
+			destLogger(dest).Info("Remote has no such branch yet, nothing to pull", "branch", branch.Short())
 			return nil
-		} else {
-			log.Println("No changes to pull or error occurred:", err)
+		}
+		return err
+	}
+	remote := remoteRef.Hash()
+
+	if remote == local {
+		destLogger(dest).Info("No changes to pull, branch is up to date", "branch", branch.Short())
+		return nil
+	}
+
+	if !local.IsZero() {
+		remoteIsAncestor, err := isAncestor(repo, remote, local)
+		if err != nil {
+			return err
+		}
+		if remoteIsAncestor {
+			destLogger(dest).Info("No changes to pull, local branch is ahead of the remote", "branch", branch.Short())
+			return nil
+		}
+
+		localIsAncestor, err := isAncestor(repo, local, remote)
+		if err != nil {
 			return err
 		}
+		if !localIsAncestor {
+			return reconcileDiverged(repo, dest, branch, local, remote)
+		}
 	}
 
-	return nil
+	return updateBranch(repo, branch, remote)
 }
 
-func PushLocalCommits(repo *git.Repository) error {
-	err := repo.Push(&git.PushOptions{
-		Auth: &http.BasicAuth{
-			Username: os.Getenv("GH_USERNAME"),
-			Password: os.Getenv("ORIGIN_TOKEN"),
-		},
-		Progress: os.Stdout,
+// isAncestor reports whether ancestor is reachable from descendant.
+func isAncestor(repo *git.Repository, ancestor, descendant plumbing.Hash) (bool, error) {
+	ancestorCommit, err := repo.CommitObject(ancestor)
+	if err != nil {
+		return false, fmt.Errorf("failed to read commit %s: %w", ancestor, err)
+	}
+	descendantCommit, err := repo.CommitObject(descendant)
+	if err != nil {
+		return false, fmt.Errorf("failed to read commit %s: %w", descendant, err)
+	}
+	return ancestorCommit.IsAncestor(descendantCommit)
+}
+
+// HasUnpushedCommits reports whether the branch HEAD points at differs from
+// its remote-tracking branch, e.g. after new commits were created, after
+// PullLatestChanges rebased or merged, or after an earlier push failed.
+func HasUnpushedCommits(repo *git.Repository) (bool, error) {
+	branch, local, err := headBranch(repo)
+	if err != nil {
+		return false, err
+	}
+	if local.IsZero() {
+		return false, nil
+	}
+
+	remoteRef, err := repo.Storer.Reference(plumbing.NewRemoteReferenceName("origin", branch.Short()))
+	if err != nil {
+		if err == plumbing.ErrReferenceNotFound {
+			return true, nil
+		}
+		return false, err
+	}
+	return remoteRef.Hash() != local, nil
+}
+
+// PushLocalCommits pushes the branch HEAD points at to the branch of the same
+// name on origin, leaving every other remote branch untouched. When the push
+// is rejected because the remote moved during the run, the remote changes are
+// pulled (and reconciled if needed) and the push is retried, up to
+// PUSH_RETRIES times (default 3).
+func PushLocalCommits(repo *git.Repository, dest internal.Destination) error {
+	retries := defaultPushRetries
+	if value := dest.Getenv("PUSH_RETRIES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s must be a non-negative integer, got %q", dest.Var("PUSH_RETRIES"), value)
+		}
+		retries = n
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := pushBranch(repo, dest)
+		if err == nil || !errors.Is(err, git.ErrNonFastForwardUpdate) || attempt >= retries {
+			return err
+		}
+
+		destLogger(dest).Warn("Push was rejected because the remote changed, pulling and retrying",
+			"attempt", attempt+1, "retries", retries, "error", err)
+		if err := PullLatestChanges(repo, dest); err != nil {
+			return fmt.Errorf("failed to pull before retrying push: %w", err)
+		}
+	}
+}
+
+func pushBranch(repo *git.Repository, dest internal.Destination) error {
+	branch, tip, err := headBranch(repo)
+	if err != nil {
+		return err
+	}
+
+	auth, err := OriginAuth(dest)
+	if err != nil {
+		return err
+	}
+
+	err = repo.Push(&git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", branch, branch))},
+		Auth:       auth,
+		Progress:   gitProgress(),
 	})
 
 	if err != nil {
-		if errors.Is(err, git.NoErrAlreadyUpToDate) {
-			log.Println("No changes to push, everything is up to date.")
-			return nil
+		if !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			if rejectedByRemote(err) {
+				return fmt.Errorf("push to origin failed: %w: %v", git.ErrNonFastForwardUpdate, err)
+			}
+			return fmt.Errorf("push to origin failed: %w", err)
 		}
-		return fmt.Errorf("push to Github failed: %w", err)
+		destLogger(dest).Info("No changes to push, everything is up to date")
+	}
+
+	// go-git leaves the remote-tracking branch alone, HasUnpushedCommits
+	// compares against it.
+	remoteBranch := plumbing.NewRemoteReferenceName("origin", branch.Short())
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(remoteBranch, tip)); err != nil {
+		return fmt.Errorf("failed to update %s: %w", remoteBranch, err)
+	}
+	return nil
+}
+
+// rejectedByRemote reports whether the push error err means the remote branch
+// has commits the local one lacks, either detected by go-git before pushing or
+// reported back by the server. go-git returns neither as a sentinel error.
+func rejectedByRemote(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "non-fast-forward") || strings.Contains(message, "fetch first")
+}
+
+// FetchRemote updates the remote-tracking branch of the branch HEAD points
+// at without touching the local branch. The refspec is explicit because
+// single-branch clones only track origin/HEAD by default.
+func FetchRemote(repo *git.Repository, dest internal.Destination) error {
+	branch, _, err := headBranch(repo)
+	if err != nil {
+		return err
+	}
+
+	auth, err := OriginAuth(dest)
+	if err != nil {
+		return err
+	}
+
+	remoteBranch := plumbing.NewRemoteReferenceName("origin", branch.Short())
+	err = repo.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", branch, remoteBranch))},
+		Auth:       auth,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) && !errors.Is(err, transport.ErrEmptyRemoteRepository) &&
+		!errors.Is(err, git.NoMatchingRefSpecError{}) {
+		return fmt.Errorf("fetch from origin failed: %w", err)
+	}
+	return nil
+}
+
+// ForcePushHistory replaces the remote branch with the local one and pushes
+// the backup ref created by RebuildHistory or PruneHistory alongside it.
+func ForcePushHistory(repo *git.Repository, dest internal.Destination, backup plumbing.ReferenceName) error {
+	branch, _, err := headBranch(repo)
+	if err != nil {
+		return err
+	}
+
+	refSpecs := []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", branch, branch))}
+	if backup != "" {
+		refSpecs = append(refSpecs, config.RefSpec(fmt.Sprintf("%s:%s", backup, backup)))
+	}
+
+	auth, err := OriginAuth(dest)
+	if err != nil {
+		return err
+	}
+
+	err = repo.Push(&git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   refSpecs,
+		Auth:       auth,
+		Progress:   gitProgress(),
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("force push to origin failed: %w", err)
 	}
 	return nil
 }
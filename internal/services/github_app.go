@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+const defaultGitHubAPIURL = "https://api.github.com"
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var (
+	appTokenMu sync.Mutex
+	// appTokens caches tokens by app, installation and repository, so
+	// destinations using different apps do not evict each other's token.
+	appTokens = make(map[string]installationToken)
+)
+
+// GetAppInstallationToken returns an installation token for the GitHub App
+// configured for dest through GH_APP_ID and GH_APP_PRIVATE_KEY. The
+// installation is taken from GH_APP_INSTALLATION_ID or looked up for
+// ORIGIN_REPO_URL, on the API the forge of dest is reached at, so GitHub
+// Enterprise destinations mint their tokens on their own host. Tokens
+// are cached and minted again shortly before they expire, so long running
+// processes can keep calling this before every git operation.
+func GetAppInstallationToken(dest internal.Destination) (string, error) {
+	f, err := destinationForge(dest)
+	if err != nil {
+		return "", err
+	}
+	apiURL := f.apiURL
+	appID := dest.Getenv("GH_APP_ID")
+	installationID := dest.Getenv("GH_APP_INSTALLATION_ID")
+
+	appTokenMu.Lock()
+	defer appTokenMu.Unlock()
+
+	repoURL := dest.Getenv("ORIGIN_REPO_URL")
+	key := apiURL + "|" + appID + "|" + installationID + "|" + repoURL
+	if cached, ok := appTokens[key]; ok && time.Until(cached.ExpiresAt) > 5*time.Minute {
+		return cached.Token, nil
+	}
+
+	privateKey, err := parseAppPrivateKey(dest.Getenv("GH_APP_PRIVATE_KEY"))
+	if err != nil {
+		return "", err
+	}
+	jwt, err := appJWT(appID, privateKey, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	if installationID == "" {
+		installationID, err = repoInstallationID(apiURL, jwt, repoURL)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var token installationToken
+	url := fmt.Sprintf("%s/app/installations/%s/access_tokens", apiURL, installationID)
+	if err := githubAppRequest(http.MethodPost, url, jwt, http.StatusCreated, &token); err != nil {
+		return "", fmt.Errorf("failed to create installation token: %w", err)
+	}
+	if token.Token == "" {
+		return "", errors.New("failed to create installation token: empty token in response")
+	}
+
+	appTokens[key] = token
+	return token.Token, nil
+}
+
+func parseAppPrivateKey(pemData string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil {
+		return nil, errors.New("GH_APP_PRIVATE_KEY does not contain a PEM encoded key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse GH_APP_PRIVATE_KEY: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("GH_APP_PRIVATE_KEY is not an RSA key")
+	}
+	return key, nil
+}
+
+// appJWT creates the RS256 signed token GitHub expects when authenticating
+// as the app itself. It is backdated a minute to allow for clock drift.
+func appJWT(appID string, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign app JWT: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// repoInstallationID looks up the installation of the app on the repository
+// behind repoURL.
+func repoInstallationID(apiURL, jwt, repoURL string) (string, error) {
+	owner, repo, err := repoNamespaceAndName(repoURL)
+	if err != nil {
+		return "", err
+	}
+
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	url := fmt.Sprintf("%s/repos/%s/%s/installation", apiURL, owner, repo)
+	if err := githubAppRequest(http.MethodGet, url, jwt, http.StatusOK, &installation); err != nil {
+		return "", fmt.Errorf("failed to find app installation for %s/%s: %w", owner, repo, err)
+	}
+	return fmt.Sprint(installation.ID), nil
+}
+
+func githubAppRequest(method, url, jwt string, expectedStatus int, target any) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	req, err := http.NewRequestWithContext(context.Background(), method, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making the request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("status %d: %s", res.StatusCode, string(body))
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(target); err != nil {
+		return fmt.Errorf("decode error: %w", err)
+	}
+	return nil
+}
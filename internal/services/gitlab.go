@@ -5,11 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,17 +18,20 @@ import (
 	"github.com/furmanp/gitlab-activity-importer/internal"
 )
 
+// gitlabClient is shared by all GitLab API calls so a long running daemon
+// reuses its connections between syncs.
+var gitlabClient = &http.Client{Timeout: 30 * time.Second}
+
 func GetGitlabUser() (internal.GitLabUser, error) {
 	url := os.Getenv("BASE_URL")
 
-	client := &http.Client{Timeout: 30 * time.Second}
 	req, err := http.NewRequestWithContext(context.Background(), "GET", fmt.Sprintf("%v/api/v4/user", url), nil)
 	if err != nil {
 		return internal.GitLabUser{}, fmt.Errorf("failed to create request: %v", err)
 	}
 	req.Header.Set("PRIVATE-TOKEN", os.Getenv("GITLAB_TOKEN"))
 
-	res, err := client.Do(req)
+	res, err := doGitlabRequest(req)
 	if err != nil {
 		return internal.GitLabUser{}, fmt.Errorf("error making the request: %v", err)
 	}
@@ -46,12 +50,59 @@ func GetGitlabUser() (internal.GitLabUser, error) {
 	return user, nil
 }
 
+// FindGitlabUser looks up the user with the given username.
+func FindGitlabUser(username string) (internal.GitLabUser, error) {
+	req, err := http.NewRequestWithContext(context.Background(), "GET",
+		fmt.Sprintf("%s/api/v4/users?username=%s", os.Getenv("BASE_URL"), url.QueryEscape(username)), nil)
+	if err != nil {
+		return internal.GitLabUser{}, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("PRIVATE-TOKEN", os.Getenv("GITLAB_TOKEN"))
+
+	res, err := doGitlabRequest(req)
+	if err != nil {
+		return internal.GitLabUser{}, fmt.Errorf("error making the request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return internal.GitLabUser{}, fmt.Errorf("status %d: %s", res.StatusCode, string(body))
+	}
+
+	var users []internal.GitLabUser
+	if err := json.NewDecoder(res.Body).Decode(&users); err != nil {
+		return internal.GitLabUser{}, fmt.Errorf("decode error: %w", err)
+	}
+	if len(users) == 0 {
+		return internal.GitLabUser{}, fmt.Errorf("no GitLab user named %s", username)
+	}
+	return users[0], nil
+}
+
+// GetImportedUser returns the user whose activity is imported. That is the
+// owner of GITLAB_TOKEN unless GITLAB_USERNAME names someone else, e.g. when
+// an admin token imports the activity of another user.
+func GetImportedUser() (internal.GitLabUser, error) {
+	owner, err := GetGitlabUser()
+	if err != nil {
+		return internal.GitLabUser{}, err
+	}
+	username := os.Getenv("GITLAB_USERNAME")
+	if username == "" || strings.EqualFold(username, owner.Username) {
+		return owner, nil
+	}
+
+	slog.Warn("GITLAB_USERNAME differs from the owner of GITLAB_TOKEN, importing the activity of GITLAB_USERNAME",
+		"component", "gitlab", "gitlab_username", username, "token_owner", owner.Username)
+	return FindGitlabUser(username)
+}
+
 func GetUsersProjectsIds(userId int) ([]int, error) {
 	base := os.Getenv("BASE_URL")
 	token := os.Getenv("GITLAB_TOKEN")
 
 	allProjectIds := make([]int, 0, 128)
-	client := &http.Client{Timeout: 30 * time.Second}
 
 	for page := 1; ; {
 		req, err := http.NewRequestWithContext(context.Background(),
@@ -64,7 +115,7 @@ func GetUsersProjectsIds(userId int) ([]int, error) {
 		}
 		req.Header.Set("PRIVATE-TOKEN", token)
 
-		res, err := client.Do(req)
+		res, err := doGitlabRequest(req)
 		if err != nil {
 			return nil, fmt.Errorf("do request: %w", err)
 		}
@@ -90,6 +141,8 @@ func GetUsersProjectsIds(userId int) ([]int, error) {
 			for _, p := range projects {
 				allProjectIds = append(allProjectIds, p.ID)
 			}
+			internal.GitLabPages.Inc()
+			slog.Debug("Fetched contributed projects", "component", "gitlab", "page", page, "projects", len(projects))
 
 			next = res.Header.Get("X-Next-Page")
 		}()
@@ -115,7 +168,6 @@ func GetProjectCommits(projectId int, gitlabUserName string) ([]internal.Commit,
 	token := os.Getenv("GITLAB_TOKEN")
 
 	var allCommits []internal.Commit
-	client := &http.Client{Timeout: 30 * time.Second}
 	for page := 1; ; {
 		req, err := http.NewRequestWithContext(context.Background(), "GET",
 			fmt.Sprintf("%s/api/v4/projects/%d/repository/commits?author=%s&per_page=100&page=%d",
@@ -125,7 +177,7 @@ func GetProjectCommits(projectId int, gitlabUserName string) ([]internal.Commit,
 		}
 		req.Header.Set("PRIVATE-TOKEN", token)
 
-		res, err := client.Do(req)
+		res, err := doGitlabRequest(req)
 		if err != nil {
 			return nil, fmt.Errorf("do request: %w", err)
 		}
@@ -145,6 +197,8 @@ func GetProjectCommits(projectId int, gitlabUserName string) ([]internal.Commit,
 			}
 
 			allCommits = append(allCommits, batch...)
+			internal.GitLabPages.Inc()
+			slog.Debug("Fetched commits", "component", "gitlab", "project_id", projectId, "page", page, "commits", len(batch))
 			next = res.Header.Get("X-Next-Page")
 		}()
 		if err != nil {
@@ -165,34 +219,122 @@ func GetProjectCommits(projectId int, gitlabUserName string) ([]internal.Commit,
 	return allCommits, nil
 }
 
-func FetchAllCommits(projectIds []int, gitlabUserName string, commitChannel chan []internal.Commit) {
+// GetCommit fetches the commit sha of the project with the given ID, e.g.
+// one listed in a push hook, whose payload lacks the authored date.
+func GetCommit(projectId int, sha string) (internal.Commit, error) {
+	req, err := http.NewRequestWithContext(context.Background(), "GET",
+		fmt.Sprintf("%s/api/v4/projects/%d/repository/commits/%s", os.Getenv("BASE_URL"), projectId, url.PathEscape(sha)), nil)
+	if err != nil {
+		return internal.Commit{}, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("PRIVATE-TOKEN", os.Getenv("GITLAB_TOKEN"))
+
+	res, err := doGitlabRequest(req)
+	if err != nil {
+		return internal.Commit{}, fmt.Errorf("error making the request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return internal.Commit{}, fmt.Errorf("status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var commit internal.Commit
+	if err := json.NewDecoder(res.Body).Decode(&commit); err != nil {
+		return internal.Commit{}, fmt.Errorf("decode error: %w", err)
+	}
+	return commit, nil
+}
+
+// ProjectExists reports whether the project with the given ID still exists.
+// Only a 404 counts as deleted, any other failure is returned as an error so
+// that callers never mistake an unreachable API for a deleted project.
+func ProjectExists(projectId int) (bool, error) {
+	req, err := http.NewRequestWithContext(context.Background(), "GET",
+		fmt.Sprintf("%s/api/v4/projects/%d", os.Getenv("BASE_URL"), projectId), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("PRIVATE-TOKEN", os.Getenv("GITLAB_TOKEN"))
+
+	res, err := doGitlabRequest(req)
+	if err != nil {
+		return false, fmt.Errorf("error making the request: %v", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		body, _ := io.ReadAll(res.Body)
+		return false, fmt.Errorf("project %d: status %d: %s", projectId, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+}
+
+// doGitlabRequest sends req and records it in the GitLab request metrics.
+func doGitlabRequest(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	res, err := gitlabClient.Do(req)
+	internal.GitLabRequestDuration.Observe(time.Since(started).Seconds())
+	if err != nil {
+		internal.GitLabRequests.Inc("status", "error")
+		return nil, err
+	}
+	internal.GitLabRequests.Inc("status", strconv.Itoa(res.StatusCode))
+	return res, nil
+}
+
+// FetchAllCommits fetches the commits of every project concurrently and
+// sends them to commitChannel, which is closed afterwards. It returns the
+// outcome per project, in the order of projectIds.
+func FetchAllCommits(projectIds []int, gitlabUserName string, commitChannel chan []internal.Commit) []internal.ProjectFetch {
+	instance := internal.GetGitlabInstance()
+	logger := slog.With("component", "gitlab", "instance", instance)
 	var wg sync.WaitGroup
 	var validCommitsFound atomic.Bool
+	results := make([]internal.ProjectFetch, len(projectIds))
 
-	for _, projectId := range projectIds {
+	for i, projectId := range projectIds {
 		wg.Add(1)
 
-		go func(projId int) {
+		go func(i, projId int) {
 			defer wg.Done()
 
+			started := time.Now()
 			commits, err := GetProjectCommits(projId, gitlabUserName)
+			results[i] = internal.ProjectFetch{
+				ProjectID: projId,
+				Fetched:   len(commits),
+				Seconds:   time.Since(started).Seconds(),
+			}
 			if err != nil {
-				log.Printf("Error fetching commits for project %d: %v", projId, err)
+				results[i].Error = err.Error()
+				logger.Warn("Failed to fetch commits", "project_id", projId, "error", err)
 				return
 			}
+			internal.CommitsFetched.Add(float64(len(commits)))
 			if len(commits) > 0 {
+				for i := range commits {
+					commits[i].Instance = instance
+					commits[i].ProjectIDs = []int{projId}
+				}
 				commitChannel <- commits
 				validCommitsFound.Store(true)
 			}
 
-		}(projectId)
+		}(i, projectId)
 	}
 
 	wg.Wait()
 
 	if !validCommitsFound.Load() {
-		log.Println("No valid commits found across any projects")
+		logger.Warn("No valid commits found across any projects")
 	}
 
 	close(commitChannel)
+	return results
 }
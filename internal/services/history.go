@@ -0,0 +1,374 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+const mirrorReadme = "Just a readme."
+
+// HistoryVerification compares the mirror branch with the history a rebuild
+// from scratch would produce.
+type HistoryVerification struct {
+	Expected     int
+	Actual       int
+	Matching     int
+	ExpectedHead plumbing.Hash
+	ActualHead   plumbing.Hash
+}
+
+func (v HistoryVerification) Identical() bool {
+	return v.Expected == v.Actual && v.Matching == v.Expected
+}
+
+// writeMirrorTree stores the tree shared by every mirrored commit of dest. By
+// default it only holds a readme with fixed content; with MIRROR_TREE=empty
+// it is the empty tree. Either way its hash never changes.
+func writeMirrorTree(s storer.EncodedObjectStorer, dest internal.Destination) (plumbing.Hash, error) {
+	switch mode := dest.Getenv("MIRROR_TREE"); mode {
+	case "", "readme":
+	case "empty":
+		return storeTree(s, &object.Tree{})
+	default:
+		return plumbing.ZeroHash, fmt.Errorf("unknown %s %q, expected \"readme\" or \"empty\"", dest.Var("MIRROR_TREE"), mode)
+	}
+
+	blob := s.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	writer, err := blob.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to write readme blob: %w", err)
+	}
+	if _, err := writer.Write([]byte(mirrorReadme)); err != nil {
+		writer.Close()
+		return plumbing.ZeroHash, fmt.Errorf("failed to write readme blob: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to write readme blob: %w", err)
+	}
+	blobHash, err := s.SetEncodedObject(blob)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to store readme blob: %w", err)
+	}
+
+	return storeTree(s, &object.Tree{Entries: []object.TreeEntry{
+		{Name: "readme.md", Mode: filemode.Regular, Hash: blobHash},
+	}})
+}
+
+func storeTree(s storer.EncodedObjectStorer, tree *object.Tree) (plumbing.Hash, error) {
+	treeObject := s.NewEncodedObject()
+	if err := tree.Encode(treeObject); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to encode tree: %w", err)
+	}
+	treeHash, err := s.SetEncodedObject(treeObject)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to store tree: %w", err)
+	}
+	return treeHash, nil
+}
+
+// writeMirrorCommit stores the mirrored counterpart of commit on top of
+// parent, signed by signer unless it is nil. Everything that ends up in the
+// commit object is derived from the source commit and the configured
+// identity of dest, so the same input always yields the same hash as long as the
+// signature scheme is deterministic (Ed25519, RSA).
+func writeMirrorCommit(s storer.EncodedObjectStorer, dest internal.Destination, tree, parent plumbing.Hash, commit internal.Commit, signer commitSigner) (plumbing.Hash, error) {
+	signature := object.Signature{
+		Name:  dest.Getenv("GH_USERNAME"),
+		Email: dest.Getenv("COMMITER_EMAIL"),
+		When:  commit.AuthoredDate,
+	}
+
+	mirrored := &object.Commit{
+		Author:    signature,
+		Committer: signature,
+		Message:   commit.MirrorMessage(),
+		TreeHash:  tree,
+	}
+	if !parent.IsZero() {
+		mirrored.ParentHashes = []plumbing.Hash{parent}
+	}
+
+	return storeCommit(s, mirrored, signer)
+}
+
+// storeCommit signs commit when a signer is given and writes it to s.
+func storeCommit(s storer.EncodedObjectStorer, commit *object.Commit, signer commitSigner) (plumbing.Hash, error) {
+	commit.PGPSignature = ""
+	if signer != nil {
+		unsigned := &plumbing.MemoryObject{}
+		if err := commit.EncodeWithoutSignature(unsigned); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to encode commit: %w", err)
+		}
+		reader, err := unsigned.Reader()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		signature, err := signer.Sign(reader, commit.Committer.When)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		commit.PGPSignature = string(signature)
+	}
+
+	obj := s.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to encode commit: %w", err)
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// buildMirrorHistory writes commits as a linear chain on top of parent and
+// returns the hashes of the new commits in order. The commits keep the tree of
+// parent, so content added on the remote branch is not reverted; a new
+// history starts from the mirror tree.
+func buildMirrorHistory(s storer.EncodedObjectStorer, dest internal.Destination, parent plumbing.Hash, commits []internal.Commit) ([]plumbing.Hash, error) {
+	tree, err := parentTree(s, dest, parent)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := loadCommitSigner(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]plumbing.Hash, 0, len(commits))
+	for _, commit := range commits {
+		hash, err := writeMirrorCommit(s, dest, tree, parent, commit, signer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create commit %s: %w", commit.ID, err)
+		}
+		hashes = append(hashes, hash)
+		parent = hash
+	}
+	return hashes, nil
+}
+
+// parentTree returns the tree new commits on top of parent carry: the tree
+// of parent, or the mirror tree when there is no parent.
+func parentTree(s storer.EncodedObjectStorer, dest internal.Destination, parent plumbing.Hash) (plumbing.Hash, error) {
+	if parent.IsZero() {
+		return writeMirrorTree(s, dest)
+	}
+	commit, err := object.GetCommit(s, parent)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to read parent commit %s: %w", parent, err)
+	}
+	return commit.TreeHash, nil
+}
+
+// firstParentChain lists the commits reachable from tip by following first
+// parents, oldest first.
+func firstParentChain(repo *git.Repository, tip plumbing.Hash) ([]plumbing.Hash, error) {
+	var chain []plumbing.Hash
+	for hash := tip; !hash.IsZero(); {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %s: %w", hash, err)
+		}
+		chain = append(chain, hash)
+		if len(commit.ParentHashes) == 0 {
+			break
+		}
+		hash = commit.ParentHashes[0]
+	}
+
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// VerifyHistory rebuilds the mirror from commits in memory and compares it
+// commit by commit with the branch HEAD points at in repo.
+func VerifyHistory(repo *git.Repository, dest internal.Destination, commits []internal.Commit) (HistoryVerification, error) {
+	expected, err := buildMirrorHistory(memory.NewStorage(), dest, plumbing.ZeroHash, commits)
+	if err != nil {
+		return HistoryVerification{}, err
+	}
+
+	_, tip, err := headBranch(repo)
+	if err != nil {
+		return HistoryVerification{}, err
+	}
+	actual, err := firstParentChain(repo, tip)
+	if err != nil {
+		return HistoryVerification{}, err
+	}
+
+	result := HistoryVerification{
+		Expected:   len(expected),
+		Actual:     len(actual),
+		ActualHead: tip,
+	}
+	if len(expected) > 0 {
+		result.ExpectedHead = expected[len(expected)-1]
+	}
+	for result.Matching < len(expected) && result.Matching < len(actual) &&
+		expected[result.Matching] == actual[result.Matching] {
+		result.Matching++
+	}
+	return result, nil
+}
+
+// RebuildHistory replaces the branch HEAD points at with an orphan history
+// built from commits. The previous tip, preferring the remote's view of the
+// branch, is kept under refs/backup/ and returned so it can be pushed along
+// with the new history. The backup ref is empty when there was nothing to
+// keep.
+func RebuildHistory(repo *git.Repository, dest internal.Destination, commits []internal.Commit) (plumbing.ReferenceName, int, error) {
+	branch, previous, err := headBranch(repo)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(commits) == 0 {
+		return "", 0, fmt.Errorf("refusing to rebuild %s without any commits", branch.Short())
+	}
+
+	remoteBranch := plumbing.NewRemoteReferenceName("origin", branch.Short())
+	if ref, err := repo.Storer.Reference(remoteBranch); err == nil {
+		previous = ref.Hash()
+	} else if err != plumbing.ErrReferenceNotFound {
+		return "", 0, fmt.Errorf("failed to read %s: %w", remoteBranch, err)
+	}
+
+	var backup plumbing.ReferenceName
+	if !previous.IsZero() {
+		if backup, err = createBackupRef(repo, branch, previous); err != nil {
+			return "", 0, err
+		}
+	}
+
+	hashes, err := buildMirrorHistory(repo.Storer, dest, plumbing.ZeroHash, commits)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := updateBranch(repo, branch, hashes[len(hashes)-1]); err != nil {
+		return "", 0, err
+	}
+	return backup, len(hashes), nil
+}
+
+func createBackupRef(repo *git.Repository, branch plumbing.ReferenceName, tip plumbing.Hash) (plumbing.ReferenceName, error) {
+	backup := plumbing.ReferenceName(fmt.Sprintf("refs/backup/%s/%s", branch.Short(), time.Now().UTC().Format("20060102T150405Z")))
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(backup, tip)); err != nil {
+		return "", fmt.Errorf("failed to create backup ref %s: %w", backup, err)
+	}
+	return backup, nil
+}
+
+// PrunedCommit describes a mirrored commit removed by PruneHistory.
+type PrunedCommit struct {
+	Hash       plumbing.Hash
+	SourceID   string
+	When       time.Time
+	Instance   string
+	ProjectIDs []int
+}
+
+type PruneReport struct {
+	Removed []PrunedCommit
+	Kept    int
+	// Untraceable counts kept commits without source trailers, which were
+	// mirrored before trailers existed and cannot be attributed.
+	Untraceable int
+	Backup      plumbing.ReferenceName
+}
+
+// PruneHistory rewrites the branch HEAD points at without the commits for
+// which remove returns true, based on their source trailers. Kept commits
+// keep their content and are only re-parented and, if signing is configured,
+// signed again. Only the first-parent chain is pruned; history merged in by
+// merge commits is kept as it is. With dryRun set the report is computed but
+// the repository is left untouched.
+func PruneHistory(repo *git.Repository, dest internal.Destination, remove func(instance string, projectIDs []int) bool, dryRun bool) (PruneReport, error) {
+	branch, tip, err := headBranch(repo)
+	if err != nil {
+		return PruneReport{}, err
+	}
+	chain, err := firstParentChain(repo, tip)
+	if err != nil {
+		return PruneReport{}, err
+	}
+
+	var report PruneReport
+	var kept []*object.Commit
+	for _, hash := range chain {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return PruneReport{}, fmt.Errorf("failed to read commit %s: %w", hash, err)
+		}
+
+		instance, projectIDs := internal.ParseSourceTrailers(commit.Message)
+		if instance == "" && len(projectIDs) == 0 {
+			report.Untraceable++
+		} else if remove(instance, projectIDs) {
+			subject, _, _ := strings.Cut(commit.Message, "\n")
+			report.Removed = append(report.Removed, PrunedCommit{
+				Hash:       hash,
+				SourceID:   subject,
+				When:       commit.Author.When,
+				Instance:   instance,
+				ProjectIDs: projectIDs,
+			})
+			continue
+		}
+		kept = append(kept, commit)
+	}
+	report.Kept = len(kept)
+
+	if dryRun || len(report.Removed) == 0 {
+		return report, nil
+	}
+	if len(kept) == 0 {
+		return PruneReport{}, fmt.Errorf("refusing to prune every commit from %s", branch.Short())
+	}
+
+	signer, err := loadCommitSigner(dest)
+	if err != nil {
+		return PruneReport{}, err
+	}
+	if report.Backup, err = createBackupRef(repo, branch, tip); err != nil {
+		return PruneReport{}, err
+	}
+
+	parent := plumbing.ZeroHash
+	rewriting := false
+	for i, commit := range kept {
+		// Commits before the first removed one are left as they are.
+		if !rewriting && i < len(chain) && commit.Hash == chain[i] {
+			parent = commit.Hash
+			continue
+		}
+		rewriting = true
+
+		// Merges from DIVERGENCE_STRATEGY=merge keep their other parents,
+		// otherwise the history they merged would be dropped.
+		rewritten := *commit
+		rewritten.ParentHashes = nil
+		if !parent.IsZero() {
+			rewritten.ParentHashes = []plumbing.Hash{parent}
+		}
+		if len(commit.ParentHashes) > 1 {
+			rewritten.ParentHashes = append(rewritten.ParentHashes, commit.ParentHashes[1:]...)
+		}
+		if parent, err = storeCommit(repo.Storer, &rewritten, signer); err != nil {
+			return PruneReport{}, fmt.Errorf("failed to rewrite commit %s: %w", commit.Hash, err)
+		}
+	}
+
+	if err := updateBranch(repo, branch, parent); err != nil {
+		return PruneReport{}, err
+	}
+	return report, nil
+}
@@ -0,0 +1,24 @@
+package services
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+// destLogger returns the logger for git operations on dest.
+func destLogger(dest internal.Destination) *slog.Logger {
+	return slog.With("component", "git", "destination", dest.String())
+}
+
+// gitProgress returns where clone and push progress is written. It is only
+// shown with debug logging, where it goes to stderr next to the log.
+func gitProgress() io.Writer {
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return os.Stderr
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	strategyAbort  = "abort"
+	strategyRebase = "rebase"
+	strategyMerge  = "merge"
+)
+
+// reconcileDiverged brings branch, currently at local, together with the
+// remote tip according to the DIVERGENCE_STRATEGY of dest:
+//
+//   - abort (default) fails with a description of the divergence.
+//   - rebase replays the local-only commits on top of the remote, dropping
+//     those whose source commit the remote already has.
+//   - merge records a merge commit with the remote's tree.
+func reconcileDiverged(repo *git.Repository, dest internal.Destination, branch plumbing.ReferenceName, local, remote plumbing.Hash) error {
+	localCommit, err := repo.CommitObject(local)
+	if err != nil {
+		return fmt.Errorf("failed to read commit %s: %w", local, err)
+	}
+	remoteCommit, err := repo.CommitObject(remote)
+	if err != nil {
+		return fmt.Errorf("failed to read commit %s: %w", remote, err)
+	}
+
+	base := plumbing.ZeroHash
+	bases, err := localCommit.MergeBase(remoteCommit)
+	if err != nil {
+		return fmt.Errorf("failed to find merge base: %w", err)
+	}
+	if len(bases) > 0 {
+		base = bases[0].Hash
+	}
+
+	localOnly, err := commitsSince(repo, local, base)
+	if err != nil {
+		return err
+	}
+
+	switch strategy := dest.Getenv("DIVERGENCE_STRATEGY"); strategy {
+	case "", strategyAbort:
+		remoteOnly, err := commitsSince(repo, remote, base)
+		if err != nil {
+			return err
+		}
+		mergeBase := "no common history"
+		if !base.IsZero() {
+			mergeBase = "merge base " + base.String()
+		}
+		return fmt.Errorf("local and remote history of %s have diverged (%s, %d local and %d remote commits since); "+
+			"set %s to %q or %q, or replace the remote with \"rebuild -confirm\": %w",
+			branch.Short(), mergeBase, len(localOnly), len(remoteOnly), dest.Var("DIVERGENCE_STRATEGY"), strategyRebase, strategyMerge, git.ErrNonFastForwardUpdate)
+	case strategyRebase:
+		return rebaseOnto(repo, dest, branch, localOnly, remote)
+	case strategyMerge:
+		return mergeRemote(repo, dest, branch, localCommit, remoteCommit)
+	default:
+		return fmt.Errorf("unknown %s %q, expected %q, %q or %q", dest.Var("DIVERGENCE_STRATEGY"), strategy, strategyAbort, strategyRebase, strategyMerge)
+	}
+}
+
+// commitsSince lists the first-parent commits from tip back to, but not
+// including, base, oldest first.
+func commitsSince(repo *git.Repository, tip, base plumbing.Hash) ([]*object.Commit, error) {
+	var commits []*object.Commit
+	for hash := tip; !hash.IsZero() && hash != base; {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %s: %w", hash, err)
+		}
+		commits = append(commits, commit)
+		if len(commit.ParentHashes) == 0 {
+			break
+		}
+		hash = commit.ParentHashes[0]
+	}
+
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+	return commits, nil
+}
+
+func rebaseOnto(repo *git.Repository, dest internal.Destination, branch plumbing.ReferenceName, localOnly []*object.Commit, remote plumbing.Hash) error {
+	remoteSubjects, err := commitSubjects(repo, remote)
+	if err != nil {
+		return err
+	}
+	signer, err := loadCommitSigner(dest)
+	if err != nil {
+		return err
+	}
+
+	remoteCommit, err := repo.CommitObject(remote)
+	if err != nil {
+		return fmt.Errorf("failed to read remote commit %s: %w", remote, err)
+	}
+
+	// Mirrored commits do not change the tree, so every replayed commit
+	// carries the tree of the remote tip and keeps what was added there.
+	parent := remote
+	replayed := 0
+	for _, commit := range localOnly {
+		subject, _, _ := strings.Cut(commit.Message, "\n")
+		// Merge commits only stand for history the remote already has.
+		if len(commit.ParentHashes) > 1 || remoteSubjects[subject] {
+			continue
+		}
+
+		rewritten := *commit
+		rewritten.ParentHashes = []plumbing.Hash{parent}
+		rewritten.TreeHash = remoteCommit.TreeHash
+		if parent, err = storeCommit(repo.Storer, &rewritten, signer); err != nil {
+			return fmt.Errorf("failed to rebase commit %s: %w", commit.Hash, err)
+		}
+		replayed++
+	}
+
+	destLogger(dest).Info("Rebased local commits onto the remote branch", "commits", replayed, "branch", branch.Short())
+	return updateBranch(repo, branch, parent)
+}
+
+func mergeRemote(repo *git.Repository, dest internal.Destination, branch plumbing.ReferenceName, local, remote *object.Commit) error {
+	signer, err := loadCommitSigner(dest)
+	if err != nil {
+		return err
+	}
+
+	signature := object.Signature{
+		Name:  dest.Getenv("GH_USERNAME"),
+		Email: dest.Getenv("COMMITER_EMAIL"),
+		When:  time.Now(),
+	}
+	merge := &object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      fmt.Sprintf("Merge remote-tracking branch 'origin/%s'", branch.Short()),
+		TreeHash:     remote.TreeHash,
+		ParentHashes: []plumbing.Hash{local.Hash, remote.Hash},
+	}
+
+	hash, err := storeCommit(repo.Storer, merge, signer)
+	if err != nil {
+		return fmt.Errorf("failed to create merge commit: %w", err)
+	}
+
+	destLogger(dest).Info("Merged the remote branch", "branch", branch.Short())
+	return updateBranch(repo, branch, hash)
+}
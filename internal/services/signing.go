@@ -0,0 +1,204 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	signingFormatOpenPGP = "openpgp"
+	signingFormatSSH     = "ssh"
+)
+
+// commitSigner produces the armored signature stored in a commit's gpgsig
+// header. when is the commit date; signers that embed a creation time use it
+// instead of the current time so signed history stays reproducible.
+type commitSigner interface {
+	Sign(message io.Reader, when time.Time) ([]byte, error)
+}
+
+// loadCommitSigner reads the key configured for dest through SIGNING_KEY and
+// SIGNING_KEY_PASSPHRASE. SIGNING_FORMAT selects "openpgp" or "ssh" and is
+// detected from the key file when empty. It returns nil when commits are not
+// meant to be signed.
+func loadCommitSigner(dest internal.Destination) (commitSigner, error) {
+	keyPath := dest.Getenv("SIGNING_KEY")
+	if keyPath == "" {
+		return nil, nil
+	}
+
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	passphrase := dest.Getenv("SIGNING_KEY_PASSPHRASE")
+
+	format := dest.Getenv("SIGNING_FORMAT")
+	if format == "" {
+		format = signingFormatSSH
+		if bytes.Contains(keyData, []byte("BEGIN PGP PRIVATE KEY BLOCK")) {
+			format = signingFormatOpenPGP
+		}
+	}
+
+	switch format {
+	case signingFormatOpenPGP:
+		return newOpenPGPSigner(keyData, passphrase)
+	case signingFormatSSH:
+		return newSSHSigner(keyData, passphrase)
+	default:
+		return nil, fmt.Errorf("unknown %s %q, expected %q or %q", dest.Var("SIGNING_FORMAT"), format, signingFormatOpenPGP, signingFormatSSH)
+	}
+}
+
+type openPGPSigner struct {
+	entity *openpgp.Entity
+}
+
+func newOpenPGPSigner(keyData []byte, passphrase string) (*openPGPSigner, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(keyData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OpenPGP key: %w", err)
+	}
+	entity := entities[0]
+	if entity.PrivateKey == nil {
+		return nil, errors.New("OpenPGP key does not contain a private key")
+	}
+
+	if entity.PrivateKey.Encrypted {
+		if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt OpenPGP key: %w", err)
+		}
+	}
+	return &openPGPSigner{entity: entity}, nil
+}
+
+func (s *openPGPSigner) Sign(message io.Reader, when time.Time) ([]byte, error) {
+	var signature bytes.Buffer
+	when = s.signingTime(when)
+	config := &packet.Config{
+		Time: func() time.Time { return when },
+		// The salt notation added by default would make every signature,
+		// and with it every commit hash, differ between runs.
+		NonDeterministicSignaturesViaNotation: packet.BoolPointer(false),
+	}
+	if err := openpgp.ArmoredDetachSign(&signature, s.entity, message, config); err != nil {
+		return nil, fmt.Errorf("failed to sign commit: %w", err)
+	}
+	return signature.Bytes(), nil
+}
+
+// signingTime returns the creation time of a signature for a commit made at
+// when. Keys are usually newer than the history they sign, and a signature
+// cannot predate its key, so those are dated when the key became usable
+// instead. That time is fixed, which keeps the signatures reproducible.
+func (s *openPGPSigner) signingTime(when time.Time) time.Time {
+	if _, ok := s.entity.SigningKey(when); ok {
+		return when
+	}
+	candidates := []time.Time{s.entity.PrimaryKey.CreationTime}
+	for _, subkey := range s.entity.Subkeys {
+		candidates = append(candidates, subkey.PublicKey.CreationTime, subkey.Sig.CreationTime)
+	}
+	for _, identity := range s.entity.Identities {
+		if identity.SelfSignature != nil {
+			candidates = append(candidates, identity.SelfSignature.CreationTime)
+		}
+	}
+	slices.SortFunc(candidates, time.Time.Compare)
+	for _, candidate := range candidates {
+		if _, ok := s.entity.SigningKey(candidate); ok && candidate.After(when) {
+			return candidate
+		}
+	}
+	return when
+}
+
+// sshSigner creates signatures in the SSHSIG format git uses with
+// gpg.format=ssh.
+type sshSigner struct {
+	signer ssh.Signer
+}
+
+func newSSHSigner(keyData []byte, passphrase string) (*sshSigner, error) {
+	var signer ssh.Signer
+	var err error
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(keyData)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH signing key: %w", err)
+	}
+	return &sshSigner{signer: signer}, nil
+}
+
+func (s *sshSigner) Sign(message io.Reader, _ time.Time) ([]byte, error) {
+	const namespace = "git"
+	const hashAlgorithm = "sha512"
+
+	hash := sha512.New()
+	if _, err := io.Copy(hash, message); err != nil {
+		return nil, err
+	}
+
+	var signedData bytes.Buffer
+	signedData.WriteString("SSHSIG")
+	writeSSHString(&signedData, []byte(namespace))
+	writeSSHString(&signedData, nil)
+	writeSSHString(&signedData, []byte(hashAlgorithm))
+	writeSSHString(&signedData, hash.Sum(nil))
+
+	var signature *ssh.Signature
+	var err error
+	// RSA keys must not sign with SHA-1, which plain Sign would use.
+	if algorithmSigner, ok := s.signer.(ssh.AlgorithmSigner); ok && s.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, signedData.Bytes(), ssh.KeyAlgoRSASHA512)
+	} else {
+		signature, err = s.signer.Sign(rand.Reader, signedData.Bytes())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign commit: %w", err)
+	}
+
+	var blob bytes.Buffer
+	blob.WriteString("SSHSIG")
+	binary.Write(&blob, binary.BigEndian, uint32(1))
+	writeSSHString(&blob, s.signer.PublicKey().Marshal())
+	writeSSHString(&blob, []byte(namespace))
+	writeSSHString(&blob, nil)
+	writeSSHString(&blob, []byte(hashAlgorithm))
+	writeSSHString(&blob, ssh.Marshal(signature))
+
+	encoded := base64.StdEncoding.EncodeToString(blob.Bytes())
+	var armored strings.Builder
+	armored.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(encoded) > 70 {
+		armored.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	armored.WriteString(encoded + "\n")
+	armored.WriteString("-----END SSH SIGNATURE-----\n")
+	return []byte(armored.String()), nil
+}
+
+func writeSSHString(buf *bytes.Buffer, value []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(value)))
+	buf.Write(value)
+}
@@ -2,15 +2,30 @@ package internal
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	countTrailer    = "Commit-Count"
+	instanceTrailer = "Source-Instance"
+	projectTrailer  = "Source-Project"
+)
+
 type Commit struct {
 	ID           string    `json:"id"`
 	Message      string    `json:"message"`
 	AuthorName   string    `json:"author_name"`
 	AuthorMail   string    `json:"author_email"`
 	AuthoredDate time.Time `json:"authored_date"`
+	// Count is the number of source commits a mirrored commit stands for.
+	// It is only set on commits produced by daily aggregation.
+	Count int `json:"-"`
+	// Instance and ProjectIDs record where the commit was fetched from. They
+	// end up as trailers on the mirrored commit so it can be traced back.
+	Instance   string `json:"-"`
+	ProjectIDs []int  `json:"-"`
 }
 
 type GitLabUser struct {
@@ -18,6 +33,50 @@ type GitLabUser struct {
 	Username string `json:"username"`
 }
 
+// MirrorMessage returns the message used for the mirrored commit. The first
+// line is always the commit ID, which is how already imported commits are
+// recognised on later runs. It is followed by trailers describing the source.
+func (c Commit) MirrorMessage() string {
+	var trailers []string
+	if c.Count > 0 {
+		trailers = append(trailers, fmt.Sprintf("%s: %d", countTrailer, c.Count))
+	}
+	if c.Instance != "" {
+		trailers = append(trailers, fmt.Sprintf("%s: %s", instanceTrailer, c.Instance))
+	}
+	for _, projectID := range c.ProjectIDs {
+		trailers = append(trailers, fmt.Sprintf("%s: %d", projectTrailer, projectID))
+	}
+
+	if len(trailers) == 0 {
+		return c.ID
+	}
+	return c.ID + "\n\n" + strings.Join(trailers, "\n")
+}
+
+// ParseSourceTrailers extracts the source instance and projects from the
+// message of a mirrored commit. Commits mirrored before trailers were added
+// yield an empty instance and no projects.
+func ParseSourceTrailers(message string) (string, []int) {
+	var instance string
+	var projectIDs []int
+	for _, line := range strings.Split(message, "\n") {
+		key, value, found := strings.Cut(line, ": ")
+		if !found {
+			continue
+		}
+		switch key {
+		case instanceTrailer:
+			instance = value
+		case projectTrailer:
+			if projectID, err := strconv.Atoi(value); err == nil {
+				projectIDs = append(projectIDs, projectID)
+			}
+		}
+	}
+	return instance, projectIDs
+}
+
 func (c Commit) Print() {
 	fmt.Printf("Commit Details:\n")
 	fmt.Printf("ID           : %s\n", c.ID)
@@ -2,7 +2,8 @@ package internal
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,14 +12,21 @@ import (
 )
 
 func CheckEnvVariables() error {
+	missingVars, err := missingEnvVariables()
+	if err != nil {
+		return err
+	}
+	if len(missingVars) > 0 {
+		return fmt.Errorf("missing required environment variables: %s", strings.Join(missingVars, ", "))
+	}
+	return nil
+}
+
+// missingEnvVariables lists the unset variables required to run.
+func missingEnvVariables() ([]string, error) {
 	requiredEnvVars := []string{
 		"BASE_URL",
 		"GITLAB_TOKEN",
-		"GITLAB_USERNAME",
-		"GH_USERNAME",
-		"COMMITER_EMAIL",
-		"ORIGIN_REPO_URL",
-		"ORIGIN_TOKEN",
 	}
 
 	var missingVars []string
@@ -28,10 +36,40 @@ func CheckEnvVariables() error {
 		}
 	}
 
-	if len(missingVars) > 0 {
-		return fmt.Errorf("missing required environment variables: %s", strings.Join(missingVars, ", "))
+	destinations, err := GetDestinations()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	for _, dest := range destinations {
+		missingVars = append(missingVars, dest.missingVariables()...)
+	}
+	return missingVars, nil
+}
+
+// missingVariables lists the unset variables dest needs to push.
+func (d Destination) missingVariables() []string {
+	requiredEnvVars := []string{
+		"GH_USERNAME",
+		"COMMITER_EMAIL",
+		"ORIGIN_REPO_URL",
+	}
+	// SSH remotes authenticate with a deploy key or ssh-agent and GitHub
+	// Apps with a private key instead.
+	switch {
+	case IsSSHURL(d.Getenv("ORIGIN_REPO_URL")):
+	case d.Getenv("GH_APP_ID") != "":
+		requiredEnvVars = append(requiredEnvVars, "GH_APP_PRIVATE_KEY")
+	default:
+		requiredEnvVars = append(requiredEnvVars, "ORIGIN_TOKEN")
+	}
+
+	var missingVars []string
+	for _, envVar := range requiredEnvVars {
+		if d.Getenv(envVar) == "" {
+			missingVars = append(missingVars, d.Var(envVar))
+		}
+	}
+	return missingVars
 }
 
 func LoadEnv() error {
@@ -51,7 +89,11 @@ func LoadEnv() error {
 
 func SetupEnv() error {
 	if err := LoadEnv(); err != nil {
-		log.Printf("Could not load .env file: %v.", err)
+		slog.Warn("Could not load .env file", "error", err)
+	}
+
+	if err := ResolveSecrets(); err != nil {
+		return fmt.Errorf("failed to read secrets: %w", err)
 	}
 
 	if err := CheckEnvVariables(); err != nil {
@@ -64,7 +106,73 @@ func SetupEnv() error {
 func GetHomeDirectory() string {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		log.Fatal("Unable to get the user home directory:", err)
+		slog.Error("Unable to get the user home directory", "error", err)
+		os.Exit(1)
 	}
 	return homeDir
 }
+
+// GetGitlabInstance returns the host of BASE_URL, which identifies the GitLab
+// instance commits are fetched from.
+func GetGitlabInstance() string {
+	baseURL, err := url.Parse(os.Getenv("BASE_URL"))
+	if err != nil || baseURL.Host == "" {
+		return os.Getenv("BASE_URL")
+	}
+	return baseURL.Host
+}
+
+// IsSSHURL reports whether repoURL is an ssh:// URL or an scp-like address
+// such as git@github.com:user/repo.git.
+func IsSSHURL(repoURL string) bool {
+	if strings.HasPrefix(repoURL, "ssh://") {
+		return true
+	}
+	if strings.Contains(repoURL, "://") {
+		return false
+	}
+	at := strings.Index(repoURL, "@")
+	colon := strings.Index(repoURL, ":")
+	return at > 0 && colon > at
+}
+
+// GetWorkDir returns the directory holding the local clones. workDir takes
+// precedence over the WORKDIR variable, which defaults to ~/commits-importer.
+func GetWorkDir(workDir string) string {
+	if workDir == "" {
+		workDir = os.Getenv("WORKDIR")
+	}
+	if workDir == "" {
+		workDir = filepath.Join(GetHomeDirectory(), "commits-importer")
+	}
+	return workDir
+}
+
+// GetRepoPath returns the directory holding the local clone of dest inside
+// the workdir. Every destination gets its own subdirectory so several
+// destinations and configurations can share one workdir.
+func GetRepoPath(dest Destination, workDir string) string {
+	return filepath.Join(GetWorkDir(workDir), destinationDirName(dest.Getenv("ORIGIN_REPO_URL")))
+}
+
+// destinationDirName turns a repository URL into a directory name, e.g.
+// https://github.com/user/repo.git becomes github.com_user_repo.
+func destinationDirName(repoURL string) string {
+	name := repoURL
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[i+3:]
+	}
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(name, "/"), ".git")
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PushEvent is the part of a GitLab push hook, or of a push system hook,
+// that the importer uses.
+type PushEvent struct {
+	ObjectKind        string `json:"object_kind"`
+	EventName         string `json:"event_name"`
+	Ref               string `json:"ref"`
+	ProjectID         int    `json:"project_id"`
+	TotalCommitsCount int    `json:"total_commits_count"`
+	Project           struct {
+		DefaultBranch string `json:"default_branch"`
+	} `json:"project"`
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		Author  struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"author"`
+	} `json:"commits"`
+}
+
+// ParsePushEvent decodes the body of a GitLab webhook request.
+func ParsePushEvent(body []byte) (PushEvent, error) {
+	var event PushEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return PushEvent{}, fmt.Errorf("failed to decode webhook payload: %w", err)
+	}
+	return event, nil
+}
+
+// IsDefaultBranchPush reports whether the event is a push to the default
+// branch of the project, the only branch the importer fetches commits from.
+func (e PushEvent) IsDefaultBranchPush() bool {
+	if e.ObjectKind != "push" && e.EventName != "push" {
+		return false
+	}
+	return e.Project.DefaultBranch != "" && e.Ref == "refs/heads/"+e.Project.DefaultBranch
+}
+
+// Complete reports whether the payload lists every pushed commit. GitLab
+// only includes the latest 20 commits of a push.
+func (e PushEvent) Complete() bool {
+	return e.TotalCommitsCount <= len(e.Commits)
+}
+
+// CommitsBy returns the pushed commits whose author matches author the way
+// the author filter of the GitLab commits API does, i.e. author is contained
+// in "Name <email>". The timestamp in the payload is the committed date, so
+// the returned commits carry no AuthoredDate; it has to be fetched from the
+// API before they are mirrored.
+func (e PushEvent) CommitsBy(author string) []Commit {
+	var commits []Commit
+	for _, c := range e.Commits {
+		if author == "" || !strings.Contains(c.Author.Name+" <"+c.Author.Email+">", author) {
+			continue
+		}
+		commits = append(commits, Commit{
+			ID:         c.ID,
+			Message:    c.Message,
+			AuthorName: c.Author.Name,
+			AuthorMail: c.Author.Email,
+			Instance:   GetGitlabInstance(),
+			ProjectIDs: []int{e.ProjectID},
+		})
+	}
+	return commits
+}
@@ -0,0 +1,137 @@
+package services_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+func TestAggregateCommits(t *testing.T) {
+	day1 := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	day2 := time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)
+	commits := []internal.Commit{
+		{ID: "c", AuthoredDate: day1.Add(2 * time.Hour)},
+		{ID: "d", AuthoredDate: day2},
+		{ID: "a", AuthoredDate: day1},
+		{ID: "b", AuthoredDate: day1.Add(time.Hour)},
+	}
+
+	tests := []struct {
+		name        string
+		config      internal.AggregationConfig
+		expectedIDs []string
+		counts      []int
+	}{
+		{
+			name:        "disabled keeps all commits",
+			config:      internal.AggregationConfig{},
+			expectedIDs: []string{"c", "d", "a", "b"},
+			counts:      []int{0, 0, 0, 0},
+		},
+		{
+			name:        "capped keeps earliest commits per day",
+			config:      internal.AggregationConfig{Mode: internal.AggregationCapped, DailyCap: 2},
+			expectedIDs: []string{"a", "b", "d"},
+			counts:      []int{0, 0, 0},
+		},
+		{
+			name:        "daily produces one commit per day",
+			config:      internal.AggregationConfig{Mode: internal.AggregationDaily},
+			expectedIDs: []string{"activity-2024-01-01", "activity-2024-01-02"},
+			counts:      []int{3, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := append([]internal.Commit(nil), commits...)
+			result := internal.AggregateCommits(input, tt.config)
+
+			var ids []string
+			var counts []int
+			for _, c := range result {
+				ids = append(ids, c.ID)
+				counts = append(counts, c.Count)
+			}
+			if !reflect.DeepEqual(ids, tt.expectedIDs) {
+				t.Errorf("Expected IDs %v, got %v", tt.expectedIDs, ids)
+			}
+			if !reflect.DeepEqual(counts, tt.counts) {
+				t.Errorf("Expected counts %v, got %v", tt.counts, counts)
+			}
+		})
+	}
+
+	daily := internal.AggregateCommits(commits, internal.AggregationConfig{Mode: internal.AggregationDaily})
+	if !daily[0].AuthoredDate.Equal(day1) {
+		t.Errorf("Expected daily commit dated %v, got %v", day1, daily[0].AuthoredDate)
+	}
+	if msg := daily[0].MirrorMessage(); msg != "activity-2024-01-01\n\nCommit-Count: 3" {
+		t.Errorf("Unexpected mirror message %q", msg)
+	}
+}
+
+func TestSortCommits(t *testing.T) {
+	base := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	commits := []internal.Commit{
+		{ID: "late", AuthoredDate: base.Add(time.Hour)},
+		{ID: "b", AuthoredDate: base},
+		{ID: "a", AuthoredDate: base.In(time.FixedZone("CET", 3600))},
+		{ID: "late", AuthoredDate: base.Add(time.Hour)},
+	}
+
+	result := internal.SortCommits(commits)
+
+	var ids []string
+	for _, c := range result {
+		ids = append(ids, c.ID)
+	}
+	expected := []string{"a", "b", "late"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected order %v, got %v", expected, ids)
+	}
+	if commits[0].ID != "late" {
+		t.Errorf("Expected input slice to be left untouched")
+	}
+}
+
+func TestParseSourceTrailers(t *testing.T) {
+	commit := internal.Commit{ID: "abc", Instance: "gitlab.example.com", ProjectIDs: []int{3, 7}}
+
+	message := commit.MirrorMessage()
+	expected := "abc\n\nSource-Instance: gitlab.example.com\nSource-Project: 3\nSource-Project: 7"
+	if message != expected {
+		t.Errorf("Expected message %q, got %q", expected, message)
+	}
+
+	instance, projectIDs := internal.ParseSourceTrailers(message)
+	if instance != commit.Instance || !reflect.DeepEqual(projectIDs, commit.ProjectIDs) {
+		t.Errorf("Expected %s %v, got %s %v", commit.Instance, commit.ProjectIDs, instance, projectIDs)
+	}
+
+	if instance, projectIDs := internal.ParseSourceTrailers("abc"); instance != "" || projectIDs != nil {
+		t.Errorf("Expected no trailers, got %s %v", instance, projectIDs)
+	}
+}
+
+func TestAggregateCommitsDailySkipsCurrentDay(t *testing.T) {
+	// The offset keeps the author's day from matching the UTC day, so the
+	// check must use the author's time zone.
+	zone := time.FixedZone("UTC+14", 14*60*60)
+	now := time.Now().In(zone)
+	yesterday := now.AddDate(0, 0, -1)
+	commits := []internal.Commit{
+		{ID: "a", AuthoredDate: yesterday},
+		{ID: "b", AuthoredDate: now},
+	}
+
+	result := internal.AggregateCommits(commits, internal.AggregationConfig{Mode: internal.AggregationDaily})
+	if len(result) != 1 {
+		t.Fatalf("Expected only the finished day, got %d commits", len(result))
+	}
+	if expected := "activity-" + yesterday.Format("2006-01-02"); result[0].ID != expected {
+		t.Errorf("Expected %s, got %s", expected, result[0].ID)
+	}
+}
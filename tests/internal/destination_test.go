@@ -0,0 +1,81 @@
+package services_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+func TestGetDestinations(t *testing.T) {
+	defer os.Unsetenv("DESTINATIONS")
+	defer os.Unsetenv("PERSONAL_ORIGIN_REPO_URL")
+	defer os.Unsetenv("WORK_ORIGIN_REPO_URL")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+
+	os.Setenv("DESTINATIONS", "")
+	destinations, err := internal.GetDestinations()
+	if err != nil {
+		t.Fatalf("GetDestinations returned error: %v", err)
+	}
+	if len(destinations) != 1 || destinations[0].Name != "" {
+		t.Errorf("Expected the unnamed destination, got %v", destinations)
+	}
+
+	os.Setenv("DESTINATIONS", "personal, work")
+	os.Setenv("ORIGIN_REPO_URL", "https://github.com/user/shared.git")
+	os.Setenv("PERSONAL_ORIGIN_REPO_URL", "https://github.com/user/mirror.git")
+	if _, err := internal.GetDestinations(); err == nil || !strings.Contains(err.Error(), "WORK_ORIGIN_REPO_URL") {
+		t.Errorf("Expected an error about WORK_ORIGIN_REPO_URL, got %v", err)
+	}
+
+	os.Setenv("WORK_ORIGIN_REPO_URL", "https://github.com/user/mirror.git")
+	if _, err := internal.GetDestinations(); err == nil || !strings.Contains(err.Error(), "both point at") {
+		t.Errorf("Expected an error about duplicate URLs, got %v", err)
+	}
+
+	os.Setenv("WORK_ORIGIN_REPO_URL", "https://github.example.com/user/mirror.git")
+	destinations, err = internal.GetDestinations()
+	if err != nil {
+		t.Fatalf("GetDestinations returned error: %v", err)
+	}
+	if len(destinations) != 2 || destinations[0].Name != "personal" || destinations[1].Name != "work" {
+		t.Fatalf("Expected destinations personal and work, got %v", destinations)
+	}
+	if url := destinations[1].Getenv("ORIGIN_REPO_URL"); url != "https://github.example.com/user/mirror.git" {
+		t.Errorf("Expected the prefixed repository URL, got '%s'", url)
+	}
+}
+
+func TestDestinationGetenv(t *testing.T) {
+	os.Setenv("GH_USERNAME", "shared_user")
+	os.Setenv("WORK_GH_USERNAME", "work_user")
+	os.Setenv("EXCLUDE_PROJECTS", "1,2")
+	os.Setenv("WORK_EXCLUDE_PROJECTS", "")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("WORK_GH_USERNAME")
+	defer os.Unsetenv("EXCLUDE_PROJECTS")
+	defer os.Unsetenv("WORK_EXCLUDE_PROJECTS")
+
+	personal := internal.Destination{Name: "personal"}
+	work := internal.Destination{Name: "work"}
+
+	if value := personal.Getenv("GH_USERNAME"); value != "shared_user" {
+		t.Errorf("Expected fallback to 'shared_user', got '%s'", value)
+	}
+	if value := work.Getenv("GH_USERNAME"); value != "work_user" {
+		t.Errorf("Expected 'work_user', got '%s'", value)
+	}
+
+	exclusions, err := internal.GetExclusions(work)
+	if err != nil {
+		t.Fatalf("GetExclusions returned error: %v", err)
+	}
+	if len(exclusions.Projects) != 0 {
+		t.Errorf("Expected an empty prefixed variable to clear the exclusions, got %v", exclusions.Projects)
+	}
+	if exclusions, _ := internal.GetExclusions(personal); !exclusions.Projects[1] || !exclusions.Projects[2] {
+		t.Errorf("Expected the shared exclusions, got %v", exclusions.Projects)
+	}
+}
@@ -0,0 +1,119 @@
+package services_test
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+// writeLock leaves a lock of pid in dir as another importer would.
+func writeLock(t *testing.T, dir string, pid int, age time.Duration) string {
+	t.Helper()
+	hostname, _ := os.Hostname()
+	data, _ := json.Marshal(map[string]any{"pid": pid, "hostname": hostname, "started": time.Now().Add(-age)})
+	path := filepath.Join(dir, ".importer.lock")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Failed to write lock: %v", err)
+	}
+	modified := time.Now().Add(-age)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatalf("Failed to age lock: %v", err)
+	}
+	return path
+}
+
+func TestAcquireRunLock(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "workdir")
+
+	lock, err := internal.AcquireRunLock(dir, 0)
+	if err != nil {
+		t.Fatalf("AcquireRunLock returned error: %v", err)
+	}
+	path := filepath.Join(dir, ".importer.lock")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected lock file at %s: %v", path, err)
+	}
+
+	lock.Release()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected lock file to be removed, got %v", err)
+	}
+}
+
+func TestAcquireRunLockHeldByRunningImporter(t *testing.T) {
+	dir := t.TempDir()
+	// The test's parent process keeps running while the test does.
+	writeLock(t, dir, os.Getppid(), time.Minute)
+
+	started := time.Now()
+	_, err := internal.AcquireRunLock(dir, 2*time.Second)
+	if err == nil {
+		t.Fatal("Expected an error for a workdir locked by a running importer")
+	}
+	if !strings.Contains(err.Error(), "in use by another importer") {
+		t.Errorf("Expected error to name the other importer, got %v", err)
+	}
+	if waited := time.Since(started); waited < 2*time.Second {
+		t.Errorf("Expected to wait for the lock, gave up after %v", waited)
+	}
+}
+
+func TestAcquireRunLockTakesOverStaleLocks(t *testing.T) {
+	finished := exec.Command("go", "version")
+	if err := finished.Run(); err != nil {
+		t.Fatalf("Failed to run process: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		pid  int
+		age  time.Duration
+	}{
+		{name: "process no longer running", pid: finished.Process.Pid, age: time.Minute},
+		{name: "heartbeat stopped", pid: os.Getppid(), age: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeLock(t, dir, tt.pid, tt.age)
+
+			lock, err := internal.AcquireRunLock(dir, 0)
+			if err != nil {
+				t.Fatalf("Expected the stale lock to be taken over, got %v", err)
+			}
+			lock.Release()
+
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				t.Errorf("Expected an empty workdir after release, found %s", entry.Name())
+			}
+		})
+	}
+}
+
+func TestAcquireRunLockWaitsForLockBeingWritten(t *testing.T) {
+	dir := t.TempDir()
+	// Without hard links a new lock is empty until its owner wrote it.
+	if err := os.WriteFile(filepath.Join(dir, ".importer.lock"), nil, 0o644); err != nil {
+		t.Fatalf("Failed to write lock: %v", err)
+	}
+
+	if _, err := internal.AcquireRunLock(dir, 0); err == nil {
+		t.Fatal("Expected a lock that was just created not to be taken over")
+	}
+
+	old := time.Now().Add(-time.Minute)
+	os.Chtimes(filepath.Join(dir, ".importer.lock"), old, old)
+	lock, err := internal.AcquireRunLock(dir, 0)
+	if err != nil {
+		t.Fatalf("Expected a lock without owner to be taken over, got %v", err)
+	}
+	lock.Release()
+}
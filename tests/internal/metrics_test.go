@@ -0,0 +1,43 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+func TestMetricsTextfile(t *testing.T) {
+	internal.CommitsCreated.Add(3, "destination", "metrics-test")
+	internal.LastSuccess.Set(1700000000, "destination", "metrics-test")
+	internal.PushDuration.Observe(0.7, "destination", "metrics-test")
+	internal.PushDuration.Observe(3, "destination", "metrics-test")
+
+	path := filepath.Join(t.TempDir(), "importer.prom")
+	if err := internal.GetMetrics().WriteTextfile(path); err != nil {
+		t.Fatalf("WriteTextfile returned error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	output := string(data)
+
+	expected := []string{
+		"# TYPE gitlab_activity_importer_commits_created_total counter\n",
+		`gitlab_activity_importer_commits_created_total{destination="metrics-test"} 3` + "\n",
+		`gitlab_activity_importer_last_success_timestamp_seconds{destination="metrics-test"} 1.7e+09` + "\n",
+		`gitlab_activity_importer_push_duration_seconds_bucket{destination="metrics-test",le="0.5"} 0` + "\n",
+		`gitlab_activity_importer_push_duration_seconds_bucket{destination="metrics-test",le="1"} 1` + "\n",
+		`gitlab_activity_importer_push_duration_seconds_bucket{destination="metrics-test",le="+Inf"} 2` + "\n",
+		`gitlab_activity_importer_push_duration_seconds_sum{destination="metrics-test"} 3.7` + "\n",
+		`gitlab_activity_importer_push_duration_seconds_count{destination="metrics-test"} 2` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, output)
+		}
+	}
+}
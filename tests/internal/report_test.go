@@ -0,0 +1,64 @@
+package services_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+func TestRunReportWrite(t *testing.T) {
+	destReport := &internal.DestinationReport{Name: "default", Push: internal.PushPushed}
+	destReport.CountFiltered(internal.Commit{ID: "111", ProjectIDs: []int{3}})
+	destReport.CountImported(internal.Commit{ID: "222", ProjectIDs: []int{2, 1}}, true)
+	destReport.CountImported(internal.Commit{ID: "333", ProjectIDs: []int{1}}, false)
+
+	report := internal.RunReport{
+		Command:   "import",
+		StartedAt: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Success:   true,
+		Projects: []internal.ProjectFetch{
+			{ProjectID: 2, Fetched: 1},
+			{ProjectID: 1, Fetched: 2},
+		},
+		Destinations: []*internal.DestinationReport{destReport},
+	}
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := report.Write(path); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	var decoded internal.RunReport
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Report is not valid JSON: %v", err)
+	}
+
+	if decoded.Projects[0].ProjectID != 1 || decoded.Projects[1].ProjectID != 2 {
+		t.Errorf("Expected projects sorted by ID, got %+v", decoded.Projects)
+	}
+	expected := []internal.ProjectCounts{
+		{ProjectID: 1, AlreadyImported: 1, Created: 1},
+		{ProjectID: 2, Created: 1},
+		{ProjectID: 3, Filtered: 1},
+	}
+	counts := decoded.Destinations[0].Projects
+	if len(counts) != len(expected) {
+		t.Fatalf("Expected %d project counts, got %d", len(expected), len(counts))
+	}
+	for i := range expected {
+		if *counts[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], *counts[i])
+		}
+	}
+	if decoded.Destinations[0].Push != internal.PushPushed {
+		t.Errorf("Expected push result '%s', got '%s'", internal.PushPushed, decoded.Destinations[0].Push)
+	}
+}
@@ -0,0 +1,50 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// Monday, 15 January 2024.
+	after := time.Date(2024, 1, 15, 10, 17, 30, 0, time.Local)
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"6h", after.Add(6 * time.Hour)},
+		{"@hourly", time.Date(2024, 1, 15, 11, 0, 0, 0, time.Local)},
+		{"@daily", time.Date(2024, 1, 16, 0, 0, 0, 0, time.Local)},
+		{"*/15 * * * *", time.Date(2024, 1, 15, 10, 30, 0, 0, time.Local)},
+		{"0 */6 * * *", time.Date(2024, 1, 15, 12, 0, 0, 0, time.Local)},
+		{"30 9 * * 1-5", time.Date(2024, 1, 16, 9, 30, 0, 0, time.Local)},
+		{"0 0 * * 7", time.Date(2024, 1, 21, 0, 0, 0, 0, time.Local)},
+		{"0 0 1 * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.Local)},
+		// A restricted day of month and day of week match when either does.
+		{"0 12 20 * 3", time.Date(2024, 1, 17, 12, 0, 0, 0, time.Local)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			schedule, err := internal.ParseSchedule(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseSchedule returned error: %v", err)
+			}
+			if next := schedule.Next(after); !next.Equal(tt.expected) {
+				t.Errorf("Expected next run at %v, got %v", tt.expected, next)
+			}
+		})
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"", "10s", "every day", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := internal.ParseSchedule(spec); err == nil {
+			t.Errorf("Expected an error for schedule %q, got nil", spec)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+func TestResolveSecretsFromFiles(t *testing.T) {
+	clearEnvVars(t)
+	defer clearEnvVars(t)
+	// Keep the keyring of the machine running the tests out of the way.
+	if dbus, ok := os.LookupEnv("DBUS_SESSION_BUS_ADDRESS"); ok {
+		os.Unsetenv("DBUS_SESSION_BUS_ADDRESS")
+		defer os.Setenv("DBUS_SESSION_BUS_ADDRESS", dbus)
+	}
+
+	dir := t.TempDir()
+	gitlabTokenFile := filepath.Join(dir, "gitlab_token")
+	workTokenFile := filepath.Join(dir, "work_token")
+	if err := os.WriteFile(gitlabTokenFile, []byte("gitlab-secret\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret: %v", err)
+	}
+	if err := os.WriteFile(workTokenFile, []byte("work-secret"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret: %v", err)
+	}
+
+	env := map[string]string{
+		"BASE_URL":                 "http://test-url.com",
+		"GITLAB_TOKEN_FILE":        gitlabTokenFile,
+		"GH_USERNAME":              "github_user",
+		"COMMITER_EMAIL":           "test@example.com",
+		"ORIGIN_TOKEN":             "from-env",
+		"ORIGIN_TOKEN_FILE":        workTokenFile,
+		"DESTINATIONS":             "personal,work",
+		"PERSONAL_ORIGIN_REPO_URL": "https://github.com/user/personal.git",
+		"WORK_ORIGIN_REPO_URL":     "https://github.com/user/work.git",
+		"WORK_ORIGIN_TOKEN_FILE":   workTokenFile,
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	if err := internal.SetupEnv(); err != nil {
+		t.Fatalf("SetupEnv returned error: %v", err)
+	}
+
+	work := internal.Destination{Name: "work"}
+	personal := internal.Destination{Name: "personal"}
+	if token := os.Getenv("GITLAB_TOKEN"); token != "gitlab-secret" {
+		t.Errorf("Expected GITLAB_TOKEN from its file without the newline, got %q", token)
+	}
+	if token := work.Getenv("ORIGIN_TOKEN"); token != "work-secret" {
+		t.Errorf("Expected WORK_ORIGIN_TOKEN from its file, got %q", token)
+	}
+	if token := personal.Getenv("ORIGIN_TOKEN"); token != "from-env" {
+		t.Errorf("Expected ORIGIN_TOKEN from the environment to win over its file, got %q", token)
+	}
+}
+
+func TestResolveSecretsMissingFile(t *testing.T) {
+	os.Setenv("GITLAB_TOKEN_FILE", filepath.Join(t.TempDir(), "missing"))
+	defer os.Unsetenv("GITLAB_TOKEN_FILE")
+	defer os.Unsetenv("GITLAB_TOKEN")
+
+	err := internal.ResolveSecrets()
+	if err == nil || !strings.Contains(err.Error(), "GITLAB_TOKEN_FILE") {
+		t.Errorf("Expected an error naming GITLAB_TOKEN_FILE, got %v", err)
+	}
+}
+
+func TestIsSecretVariable(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"GITLAB_TOKEN":      true,
+		"WORK_ORIGIN_TOKEN": true,
+		"WEBHOOK_SECRET":    true,
+		"ORIGIN_REPO_URL":   false,
+		"TOKEN":             false,
+	} {
+		if got := internal.IsSecretVariable(name); got != expected {
+			t.Errorf("Expected IsSecretVariable(%q) to be %v, got %v", name, expected, got)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package services_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// writeKnownHosts writes a known_hosts file trusting a new host key for
+// host and returns its path together with the key.
+func writeKnownHosts(t *testing.T, host string) (string, ssh.PublicKey) {
+	t.Helper()
+	hostPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	hostKey, err := ssh.NewPublicKey(hostPublic)
+	if err != nil {
+		t.Fatalf("Failed to convert host key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(path, []byte(knownhosts.Line([]string{host}, hostKey)+"\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+	return path, hostKey
+}
+
+func TestOriginAuthWithSSHKey(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(private, "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	knownHostsPath, hostKey := writeKnownHosts(t, "git.example.com")
+
+	os.Setenv("ORIGIN_SSH_KEY", keyPath)
+	os.Setenv("ORIGIN_SSH_KEY_PASSPHRASE", "secret")
+	os.Setenv("ORIGIN_KNOWN_HOSTS", knownHostsPath)
+	defer os.Unsetenv("ORIGIN_SSH_KEY")
+	defer os.Unsetenv("ORIGIN_SSH_KEY_PASSPHRASE")
+	defer os.Unsetenv("ORIGIN_KNOWN_HOSTS")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+
+	tests := []struct {
+		url          string
+		expectedUser string
+	}{
+		{url: "git@git.example.com:user/mirror.git", expectedUser: "git"},
+		{url: "ssh://deploy@git.example.com/user/mirror.git", expectedUser: "deploy"},
+		{url: "ssh://git.example.com/user/mirror.git", expectedUser: "git"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			os.Setenv("ORIGIN_REPO_URL", tt.url)
+			auth, err := services.OriginAuth(internal.Destination{})
+			if err != nil {
+				t.Fatalf("OriginAuth returned error: %v", err)
+			}
+			keys, ok := auth.(*gitssh.PublicKeys)
+			if !ok {
+				t.Fatalf("Expected public key auth, got %T", auth)
+			}
+			if keys.User != tt.expectedUser {
+				t.Errorf("Expected user %s, got %s", tt.expectedUser, keys.User)
+			}
+			if keys.Signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+				t.Errorf("Expected the Ed25519 key, got %s", keys.Signer.PublicKey().Type())
+			}
+
+			remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+			if err := keys.HostKeyCallback("git.example.com:22", remote, hostKey); err != nil {
+				t.Errorf("Expected the known host key to be accepted, got %v", err)
+			}
+			otherPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+			otherKey, _ := ssh.NewPublicKey(otherPublic)
+			if err := keys.HostKeyCallback("git.example.com:22", remote, otherKey); err == nil {
+				t.Errorf("Expected an unknown host key to be rejected")
+			}
+		})
+	}
+
+	os.Setenv("ORIGIN_REPO_URL", "git@git.example.com:user/mirror.git")
+	os.Setenv("ORIGIN_SSH_KEY_PASSPHRASE", "wrong")
+	if _, err := services.OriginAuth(internal.Destination{}); err == nil || !strings.Contains(err.Error(), keyPath) {
+		t.Errorf("Expected an error naming the key for a wrong passphrase, got %v", err)
+	}
+}
+
+func TestOriginAuthSSHErrors(t *testing.T) {
+	knownHostsPath, _ := writeKnownHosts(t, "git.example.com")
+
+	os.Setenv("ORIGIN_REPO_URL", "git@git.example.com:user/mirror.git")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+	defer os.Unsetenv("ORIGIN_KNOWN_HOSTS")
+
+	os.Setenv("ORIGIN_KNOWN_HOSTS", filepath.Join(t.TempDir(), "missing"))
+	if _, err := services.OriginAuth(internal.Destination{}); err == nil || !strings.Contains(err.Error(), "known_hosts") {
+		t.Errorf("Expected a known_hosts error for a missing file, got %v", err)
+	}
+
+	// Without a key the ssh-agent is used, which is not running here.
+	os.Setenv("ORIGIN_KNOWN_HOSTS", knownHostsPath)
+	agentSocket, hadAgent := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	if hadAgent {
+		defer os.Setenv("SSH_AUTH_SOCK", agentSocket)
+	}
+	if _, err := services.OriginAuth(internal.Destination{}); err == nil || !strings.Contains(err.Error(), "ssh-agent is unavailable") {
+		t.Errorf("Expected an error about the missing ssh-agent, got %v", err)
+	}
+}
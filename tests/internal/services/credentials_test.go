@@ -0,0 +1,121 @@
+package services_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+)
+
+func TestCheckGitlabCredentials(t *testing.T) {
+	tests := []struct {
+		name           string
+		tokenResponse  string
+		username       string
+		expectedPassed []bool
+	}{
+		{
+			name:           "valid token of the configured user",
+			tokenResponse:  `{"name":"importer","active":true,"scopes":["read_api","read_user"],"expires_at":"2030-01-01"}`,
+			username:       "testuser",
+			expectedPassed: []bool{true, true},
+		},
+		{
+			name:           "token without API scope",
+			tokenResponse:  `{"name":"importer","active":true,"scopes":["read_repository"]}`,
+			username:       "testuser",
+			expectedPassed: []bool{false, true},
+		},
+		{
+			name:           "token owner without GITLAB_USERNAME",
+			tokenResponse:  `{"name":"importer","active":true,"scopes":["api"]}`,
+			username:       "",
+			expectedPassed: []bool{true, true},
+		},
+		{
+			name:           "admin token importing another user",
+			tokenResponse:  `{"name":"importer","active":true,"scopes":["api"]}`,
+			username:       "otheruser",
+			expectedPassed: []bool{true, true},
+		},
+		{
+			name:           "expired token and unknown user",
+			tokenResponse:  `{"name":"importer","active":false,"scopes":["api"]}`,
+			username:       "someone-else",
+			expectedPassed: []bool{false, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v4/personal_access_tokens/self":
+					fmt.Fprint(w, tt.tokenResponse)
+				case "/api/v4/user":
+					fmt.Fprint(w, `{"username":"testuser","id":1}`)
+				case "/api/v4/users":
+					if r.URL.Query().Get("username") == "otheruser" {
+						fmt.Fprint(w, `[{"username":"otheruser","id":2}]`)
+					} else {
+						fmt.Fprint(w, `[]`)
+					}
+				default:
+					t.Errorf("Unexpected request to %s", r.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer mockServer.Close()
+
+			os.Setenv("BASE_URL", mockServer.URL)
+			os.Setenv("GITLAB_TOKEN", "token")
+			os.Setenv("GITLAB_USERNAME", tt.username)
+			defer os.Unsetenv("BASE_URL")
+			defer os.Unsetenv("GITLAB_TOKEN")
+			defer os.Unsetenv("GITLAB_USERNAME")
+
+			checks := services.CheckGitlabCredentials()
+			if len(checks) != len(tt.expectedPassed) {
+				t.Fatalf("Expected %d checks, got %d", len(tt.expectedPassed), len(checks))
+			}
+			for i, check := range checks {
+				if check.Passed != tt.expectedPassed[i] {
+					t.Errorf("Expected %s passed to be %v, got %v (%s)", check.Name, tt.expectedPassed[i], check.Passed, check.Detail)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckDestinationAccess(t *testing.T) {
+	remotePath := t.TempDir()
+	if _, err := git.PlainInit(remotePath, true); err != nil {
+		t.Fatalf("Failed to init remote: %v", err)
+	}
+
+	os.Setenv("GH_USERNAME", "github_user")
+	defer os.Unsetenv("GH_USERNAME")
+
+	for _, tt := range []struct {
+		url    string
+		passed bool
+	}{
+		{url: remotePath, passed: true},
+		{url: filepath.Join(remotePath, "missing"), passed: false},
+	} {
+		os.Setenv("ORIGIN_REPO_URL", tt.url)
+		checks := services.CheckDestinationAccess(internal.Destination{})
+		for _, check := range checks {
+			if check.Passed != tt.passed {
+				t.Errorf("Expected %s of %s passed to be %v, got %v (%s)", check.Name, tt.url, tt.passed, check.Passed, check.Detail)
+			}
+		}
+	}
+	os.Unsetenv("ORIGIN_REPO_URL")
+}
@@ -0,0 +1,170 @@
+package services_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestCreateRepository(t *testing.T) {
+	tests := []struct {
+		name       string
+		forge      string
+		path       string
+		authHeader string
+		authValue  string
+		user       string
+		createPath string
+		expected   map[string]any
+	}{
+		{
+			name:       "gitea user repository",
+			forge:      "gitea",
+			path:       "/user/mirror.git",
+			authHeader: "Authorization",
+			authValue:  "token secret",
+			user:       `{"login":"user"}`,
+			createPath: "/api/v1/user/repos",
+			expected:   map[string]any{"name": "mirror", "private": true, "default_branch": "main"},
+		},
+		{
+			name:       "forgejo organisation repository",
+			forge:      "forgejo",
+			path:       "/team/mirror.git",
+			authHeader: "Authorization",
+			authValue:  "token secret",
+			user:       `{"login":"user"}`,
+			createPath: "/api/v1/orgs/team/repos",
+			expected:   map[string]any{"name": "mirror", "private": true},
+		},
+		{
+			name:       "gitlab subgroup project",
+			forge:      "gitlab",
+			path:       "/group/sub/mirror.git",
+			authHeader: "PRIVATE-TOKEN",
+			authValue:  "secret",
+			user:       `{"username":"user"}`,
+			createPath: "/api/v4/projects",
+			expected:   map[string]any{"path": "mirror", "visibility": "private", "namespace_id": float64(12)},
+		},
+		{
+			name:       "github user repository",
+			forge:      "github",
+			path:       "/user/mirror.git",
+			authHeader: "Authorization",
+			authValue:  "Bearer secret",
+			user:       `{"login":"User"}`,
+			createPath: "/api/v3/user/repos",
+			expected:   map[string]any{"name": "mirror", "private": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var created map[string]any
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if value := r.Header.Get(tt.authHeader); value != tt.authValue {
+					t.Errorf("Expected %s header '%s', got '%s'", tt.authHeader, tt.authValue, value)
+				}
+
+				switch {
+				case r.Method == http.MethodGet && (r.URL.Path == "/api/v1/user" || r.URL.Path == "/api/v3/user" || r.URL.Path == "/api/v4/user"):
+					fmt.Fprint(w, tt.user)
+				case r.Method == http.MethodGet && r.URL.Path == "/api/v4/namespaces/group/sub":
+					fmt.Fprint(w, `{"id":12}`)
+				case r.Method == http.MethodPost && r.URL.Path == tt.createPath:
+					if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+						t.Errorf("Failed to decode request body: %v", err)
+					}
+					w.WriteHeader(http.StatusCreated)
+					fmt.Fprint(w, `{}`)
+				default:
+					t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer mockServer.Close()
+
+			os.Setenv("ORIGIN_REPO_URL", mockServer.URL+tt.path)
+			os.Setenv("ORIGIN_FORGE", tt.forge)
+			os.Setenv("ORIGIN_TOKEN", "secret")
+			defer os.Unsetenv("ORIGIN_REPO_URL")
+			defer os.Unsetenv("ORIGIN_FORGE")
+			defer os.Unsetenv("ORIGIN_TOKEN")
+
+			if err := services.CreateRepository(internal.Destination{}); err != nil {
+				t.Fatalf("CreateRepository returned error: %v", err)
+			}
+			for key, value := range tt.expected {
+				if created[key] != value {
+					t.Errorf("Expected %s to be %v, got %v", key, value, created[key])
+				}
+			}
+		})
+	}
+}
+
+func TestCloneInMemoryCreatesMissingRepository(t *testing.T) {
+	var created map[string]any
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/user":
+			fmt.Fprint(w, `{"login":"user"}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/user/repos":
+			if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+				t.Errorf("Failed to decode request body: %v", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{}`)
+		default:
+			// Git requests for the repository before it was created.
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockServer.Close()
+
+	repoURL := mockServer.URL + "/user/mirror.git"
+	os.Setenv("GH_USERNAME", "user")
+	os.Setenv("ORIGIN_REPO_URL", repoURL)
+	os.Setenv("ORIGIN_FORGE", "gitea")
+	os.Setenv("ORIGIN_TOKEN", "secret")
+	os.Setenv("ORIGIN_REPO_VISIBILITY", "public")
+	os.Setenv("ORIGIN_REPO_DESCRIPTION", "GitLab activity")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+	defer os.Unsetenv("ORIGIN_FORGE")
+	defer os.Unsetenv("ORIGIN_TOKEN")
+	defer os.Unsetenv("ORIGIN_REPO_VISIBILITY")
+	defer os.Unsetenv("ORIGIN_REPO_DESCRIPTION")
+	defer os.Unsetenv("ORIGIN_CREATE_REPO")
+
+	if _, err := services.CloneInMemory(internal.Destination{}); err == nil {
+		t.Fatal("Expected cloning a missing repository to fail without ORIGIN_CREATE_REPO")
+	}
+	if created != nil {
+		t.Fatal("Expected no repository to be created without ORIGIN_CREATE_REPO")
+	}
+
+	os.Setenv("ORIGIN_CREATE_REPO", "true")
+	repo, err := services.CloneInMemory(internal.Destination{})
+	if err != nil {
+		t.Fatalf("CloneInMemory returned error: %v", err)
+	}
+	if created["name"] != "mirror" || created["private"] != false || created["description"] != "GitLab activity" {
+		t.Errorf("Unexpected repository settings: %v", created)
+	}
+
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		t.Fatalf("Expected an origin remote: %v", err)
+	}
+	if urls := remote.Config().URLs; len(urls) != 1 || urls[0] != repoURL {
+		t.Errorf("Expected origin to point at %s, got %v", repoURL, urls)
+	}
+}
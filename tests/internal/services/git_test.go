@@ -0,0 +1,841 @@
+package services_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/crypto/ssh"
+)
+
+// dest is the unnamed destination configured through the plain variables.
+var dest internal.Destination
+
+func TestCreateLocalCommitIsReproducible(t *testing.T) {
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	commits := []internal.Commit{
+		{ID: "111", AuthoredDate: base},
+		{ID: "222", AuthoredDate: base.Add(time.Hour)},
+		{ID: "333", AuthoredDate: base.Add(2 * time.Hour)},
+	}
+
+	var heads []plumbing.Hash
+	for i := 0; i < 2; i++ {
+		repo, err := git.Init(memory.NewStorage(), nil)
+		if err != nil {
+			t.Fatalf("Failed to init repository: %v", err)
+		}
+
+		created, err := services.CreateLocalCommit(repo, dest, commits)
+		if err != nil {
+			t.Fatalf("CreateLocalCommit returned error: %v", err)
+		}
+		if created != len(commits) {
+			t.Errorf("Expected %d commits created, got %d", len(commits), created)
+		}
+
+		created, err = services.CreateLocalCommit(repo, dest, commits)
+		if err != nil {
+			t.Fatalf("CreateLocalCommit returned error: %v", err)
+		}
+		if created != 0 {
+			t.Errorf("Expected already imported commits to be skipped, got %d created", created)
+		}
+
+		result, err := services.VerifyHistory(repo, dest, commits)
+		if err != nil {
+			t.Fatalf("VerifyHistory returned error: %v", err)
+		}
+		if !result.Identical() {
+			t.Errorf("Expected history to match a rebuild, got %+v", result)
+		}
+		heads = append(heads, result.ActualHead)
+	}
+
+	if heads[0] != heads[1] {
+		t.Errorf("Expected identical heads for identical input, got %s and %s", heads[0], heads[1])
+	}
+}
+
+func TestRebuildHistory(t *testing.T) {
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	// Imported out of order, so the incremental history differs from a rebuild.
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	for _, commit := range []internal.Commit{
+		{ID: "222", AuthoredDate: base.Add(time.Hour)},
+		{ID: "111", AuthoredDate: base},
+	} {
+		if _, err := services.CreateLocalCommit(repo, dest, []internal.Commit{commit}); err != nil {
+			t.Fatalf("CreateLocalCommit returned error: %v", err)
+		}
+	}
+	previous, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Failed to read HEAD: %v", err)
+	}
+
+	commits := internal.SortCommits([]internal.Commit{
+		{ID: "111", AuthoredDate: base},
+		{ID: "222", AuthoredDate: base.Add(time.Hour)},
+	})
+	result, err := services.VerifyHistory(repo, dest, commits)
+	if err != nil {
+		t.Fatalf("VerifyHistory returned error: %v", err)
+	}
+	if result.Identical() {
+		t.Fatalf("Expected out of order history to differ from a rebuild")
+	}
+
+	backup, created, err := services.RebuildHistory(repo, dest, commits)
+	if err != nil {
+		t.Fatalf("RebuildHistory returned error: %v", err)
+	}
+	if created != 2 {
+		t.Errorf("Expected 2 commits, got %d", created)
+	}
+
+	backupRef, err := repo.Reference(backup, false)
+	if err != nil {
+		t.Fatalf("Expected backup ref %q: %v", backup, err)
+	}
+	if backupRef.Hash() != previous.Hash() {
+		t.Errorf("Expected backup to point at %s, got %s", previous.Hash(), backupRef.Hash())
+	}
+
+	result, err = services.VerifyHistory(repo, dest, commits)
+	if err != nil {
+		t.Fatalf("VerifyHistory returned error: %v", err)
+	}
+	if !result.Identical() {
+		t.Errorf("Expected rebuilt history to match, got %+v", result)
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	commits := []internal.Commit{
+		{ID: "111", AuthoredDate: base, Instance: "gitlab.com", ProjectIDs: []int{1}},
+		{ID: "222", AuthoredDate: base.Add(time.Hour), Instance: "gitlab.com", ProjectIDs: []int{2}},
+		{ID: "333", AuthoredDate: base.Add(2 * time.Hour), Instance: "gitlab.com", ProjectIDs: []int{1}},
+	}
+
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	if _, err := services.CreateLocalCommit(repo, dest, commits); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+
+	exclusions := internal.Exclusions{Projects: map[int]bool{2: true}}
+
+	report, err := services.PruneHistory(repo, dest, exclusions.Excludes, true)
+	if err != nil {
+		t.Fatalf("PruneHistory returned error: %v", err)
+	}
+	if len(report.Removed) != 1 || report.Backup != "" {
+		t.Fatalf("Expected a dry run removing one commit, got %+v", report)
+	}
+	if result, _ := services.VerifyHistory(repo, dest, commits); !result.Identical() {
+		t.Errorf("Expected dry run to leave the history untouched")
+	}
+
+	report, err = services.PruneHistory(repo, dest, exclusions.Excludes, false)
+	if err != nil {
+		t.Fatalf("PruneHistory returned error: %v", err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0].SourceID != "222" {
+		t.Errorf("Expected commit 222 to be removed, got %+v", report.Removed)
+	}
+	if report.Kept != 2 || report.Backup == "" {
+		t.Errorf("Expected 2 kept commits and a backup ref, got %+v", report)
+	}
+
+	result, err := services.VerifyHistory(repo, dest, exclusions.FilterCommits(commits))
+	if err != nil {
+		t.Fatalf("VerifyHistory returned error: %v", err)
+	}
+	if !result.Identical() {
+		t.Errorf("Expected pruned history to match a rebuild without the excluded project, got %+v", result)
+	}
+}
+
+func TestPruneHistoryKeepsMergedHistory(t *testing.T) {
+	remotePath := t.TempDir()
+	remote, err := git.PlainInit(remotePath, true)
+	if err != nil {
+		t.Fatalf("Failed to init remote: %v", err)
+	}
+
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	os.Setenv("ORIGIN_REPO_URL", remotePath)
+	os.Setenv("DIVERGENCE_STRATEGY", "merge")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+	defer os.Unsetenv("DIVERGENCE_STRATEGY")
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := services.CreateLocalCommit(remote, dest, []internal.Commit{{ID: "111", AuthoredDate: base, Instance: "gitlab.com", ProjectIDs: []int{1}}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	repo, err := services.CloneInMemory(dest)
+	if err != nil {
+		t.Fatalf("CloneInMemory returned error: %v", err)
+	}
+
+	// The local commit 222 and the remote's other work are merged.
+	if _, err := services.CreateLocalCommit(repo, dest, []internal.Commit{{ID: "222", AuthoredDate: base.Add(time.Hour), Instance: "gitlab.com", ProjectIDs: []int{2}}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	other := commitFile(t, remote, "NOTES.md", "Other work.\n")
+	if err := services.PullLatestChanges(repo, dest); err != nil {
+		t.Fatalf("PullLatestChanges returned error: %v", err)
+	}
+	if _, err := services.CreateLocalCommit(repo, dest, []internal.Commit{{ID: "333", AuthoredDate: base.Add(2 * time.Hour), Instance: "gitlab.com", ProjectIDs: []int{1}}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+
+	exclusions := internal.Exclusions{Projects: map[int]bool{2: true}}
+	report, err := services.PruneHistory(repo, dest, exclusions.Excludes, false)
+	if err != nil {
+		t.Fatalf("PruneHistory returned error: %v", err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0].SourceID != "222" {
+		t.Fatalf("Expected commit 222 to be removed, got %+v", report.Removed)
+	}
+
+	head, _ := repo.Head()
+	reachable := map[plumbing.Hash]bool{}
+	subjects := map[string]bool{}
+	iter, _ := repo.Log(&git.LogOptions{From: head.Hash()})
+	iter.ForEach(func(c *object.Commit) error {
+		reachable[c.Hash] = true
+		subject, _, _ := strings.Cut(c.Message, "\n")
+		subjects[subject] = true
+		return nil
+	})
+	if !reachable[other.Hash] {
+		t.Errorf("Expected the merged commit %s to stay reachable", other.Hash)
+	}
+	if subjects["222"] || !subjects["111"] || !subjects["333"] {
+		t.Errorf("Expected 111 and 333 without 222, got %v", subjects)
+	}
+}
+
+func TestCreateLocalCommitSignsWithSSHKey(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	os.Setenv("SIGNING_KEY", keyPath)
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+	defer os.Unsetenv("SIGNING_KEY")
+
+	commits := []internal.Commit{{ID: "111", AuthoredDate: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}}
+
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	if _, err := services.CreateLocalCommit(repo, dest, commits); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Failed to read HEAD: %v", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatalf("Failed to read commit: %v", err)
+	}
+	if !strings.HasPrefix(commit.PGPSignature, "-----BEGIN SSH SIGNATURE-----") {
+		t.Errorf("Expected an SSH signature, got %q", commit.PGPSignature)
+	}
+
+	result, err := services.VerifyHistory(repo, dest, commits)
+	if err != nil {
+		t.Fatalf("VerifyHistory returned error: %v", err)
+	}
+	if !result.Identical() {
+		t.Errorf("Expected signed history to be reproducible, got %+v", result)
+	}
+}
+
+func TestCreateLocalCommitSignsWithOpenPGPKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *packet.Config
+	}{
+		{name: "rsa", config: &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048}},
+		{name: "ed25519", config: &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entity, err := openpgp.NewEntity("github_user", "", "user@example.com", tt.config)
+			if err != nil {
+				t.Fatalf("Failed to generate key: %v", err)
+			}
+			var key bytes.Buffer
+			w, err := armor.Encode(&key, openpgp.PrivateKeyType, nil)
+			if err != nil {
+				t.Fatalf("Failed to armor key: %v", err)
+			}
+			if err := entity.SerializePrivate(w, nil); err != nil {
+				t.Fatalf("Failed to serialize key: %v", err)
+			}
+			w.Close()
+			keyPath := filepath.Join(t.TempDir(), "signing.asc")
+			if err := os.WriteFile(keyPath, key.Bytes(), 0o600); err != nil {
+				t.Fatalf("Failed to write key: %v", err)
+			}
+
+			os.Setenv("GH_USERNAME", "github_user")
+			os.Setenv("COMMITER_EMAIL", "user@example.com")
+			os.Setenv("SIGNING_KEY", keyPath)
+			defer os.Unsetenv("GH_USERNAME")
+			defer os.Unsetenv("COMMITER_EMAIL")
+			defer os.Unsetenv("SIGNING_KEY")
+
+			commits := []internal.Commit{{ID: "111", AuthoredDate: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}}
+
+			var heads []plumbing.Hash
+			for i := 0; i < 2; i++ {
+				repo, err := git.Init(memory.NewStorage(), nil)
+				if err != nil {
+					t.Fatalf("Failed to init repository: %v", err)
+				}
+				if _, err := services.CreateLocalCommit(repo, dest, commits); err != nil {
+					t.Fatalf("CreateLocalCommit returned error: %v", err)
+				}
+				head, err := repo.Head()
+				if err != nil {
+					t.Fatalf("Failed to read HEAD: %v", err)
+				}
+				heads = append(heads, head.Hash())
+
+				commit, err := repo.CommitObject(head.Hash())
+				if err != nil {
+					t.Fatalf("Failed to read commit: %v", err)
+				}
+				unsigned := &plumbing.MemoryObject{}
+				if err := commit.EncodeWithoutSignature(unsigned); err != nil {
+					t.Fatalf("Failed to encode commit: %v", err)
+				}
+				reader, _ := unsigned.Reader()
+				signer, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{entity}, reader, strings.NewReader(commit.PGPSignature), nil)
+				if err != nil {
+					t.Fatalf("Expected a valid OpenPGP signature, got %v", err)
+				}
+				if signer.PrimaryKey.KeyId != entity.PrimaryKey.KeyId {
+					t.Errorf("Expected a signature by %X, got %X", entity.PrimaryKey.KeyId, signer.PrimaryKey.KeyId)
+				}
+			}
+			if heads[0] != heads[1] {
+				t.Errorf("Expected signed builds to be reproducible, got %s and %s", heads[0], heads[1])
+			}
+		})
+	}
+}
+
+func TestCloneInMemory(t *testing.T) {
+	remotePath := t.TempDir()
+	remote, err := git.PlainInit(remotePath, true)
+	if err != nil {
+		t.Fatalf("Failed to init remote: %v", err)
+	}
+
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	os.Setenv("ORIGIN_REPO_URL", remotePath)
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+
+	empty, err := services.CloneInMemory(dest)
+	if err != nil {
+		t.Fatalf("CloneInMemory of an empty remote returned error: %v", err)
+	}
+	if _, err := empty.Remote("origin"); err != nil {
+		t.Errorf("Expected origin remote on empty clone: %v", err)
+	}
+
+	commits := []internal.Commit{{ID: "111", AuthoredDate: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}}
+	if _, err := services.CreateLocalCommit(remote, dest, commits); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+
+	repo, err := services.CloneInMemory(dest)
+	if err != nil {
+		t.Fatalf("CloneInMemory returned error: %v", err)
+	}
+	created, err := services.CreateLocalCommit(repo, dest, commits)
+	if err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	if created != 0 {
+		t.Errorf("Expected commits from the remote to be recognised, got %d created", created)
+	}
+}
+
+func TestPullLatestChangesOnBareClone(t *testing.T) {
+	remotePath := t.TempDir()
+	remote, err := git.PlainInit(remotePath, true)
+	if err != nil {
+		t.Fatalf("Failed to init remote: %v", err)
+	}
+
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	os.Setenv("ORIGIN_REPO_URL", remotePath)
+	os.Setenv("MIRROR_TREE", "empty")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+	defer os.Unsetenv("MIRROR_TREE")
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := services.CreateLocalCommit(remote, dest, []internal.Commit{{ID: "111", AuthoredDate: base}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+
+	repo, err := services.OpenOrInitClone(dest, filepath.Join(t.TempDir(), "clone"))
+	if err != nil {
+		t.Fatalf("OpenOrInitClone returned error: %v", err)
+	}
+	if _, err := repo.Worktree(); err != git.ErrIsBareRepository {
+		t.Errorf("Expected a bare clone, got %v", err)
+	}
+
+	if _, err := services.CreateLocalCommit(remote, dest, []internal.Commit{{ID: "222", AuthoredDate: base.Add(time.Hour)}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	if err := services.PullLatestChanges(repo, dest); err != nil {
+		t.Fatalf("PullLatestChanges returned error: %v", err)
+	}
+	remoteHead, _ := remote.Head()
+	localHead, _ := repo.Head()
+	if localHead.Hash() != remoteHead.Hash() {
+		t.Errorf("Expected fast-forward to %s, got %s", remoteHead.Hash(), localHead.Hash())
+	}
+
+	commit, err := repo.CommitObject(localHead.Hash())
+	if err != nil {
+		t.Fatalf("Failed to read commit: %v", err)
+	}
+	if commit.TreeHash != plumbing.NewHash("4b825dc642cb6eb9a060e54bf8d69288fbee4904") {
+		t.Errorf("Expected the empty tree, got %s", commit.TreeHash)
+	}
+
+	if _, err := services.CreateLocalCommit(remote, dest, []internal.Commit{{ID: "333", AuthoredDate: base.Add(2 * time.Hour)}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	if _, err := services.CreateLocalCommit(repo, dest, []internal.Commit{{ID: "444", AuthoredDate: base.Add(3 * time.Hour)}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	if err := services.PullLatestChanges(repo, dest); !errors.Is(err, git.ErrNonFastForwardUpdate) {
+		t.Errorf("Expected diverged history to be reported, got %v", err)
+	}
+}
+
+func TestSelectBranchCreatesConfiguredBranch(t *testing.T) {
+	remotePath := t.TempDir()
+	remote, err := git.PlainInit(remotePath, true)
+	if err != nil {
+		t.Fatalf("Failed to init remote: %v", err)
+	}
+
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	os.Setenv("ORIGIN_REPO_URL", remotePath)
+	os.Setenv("ORIGIN_BRANCH", "contributions")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+	defer os.Unsetenv("ORIGIN_BRANCH")
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := services.CreateLocalCommit(remote, dest, []internal.Commit{{ID: "111", AuthoredDate: base}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	untouched, err := remote.Reference(plumbing.NewBranchReferenceName("master"), false)
+	if err != nil {
+		t.Fatalf("Failed to read remote master: %v", err)
+	}
+
+	repo, err := services.CloneInMemory(dest)
+	if err != nil {
+		t.Fatalf("CloneInMemory returned error: %v", err)
+	}
+	if err := services.SelectBranch(repo, "contributions"); err != nil {
+		t.Fatalf("SelectBranch returned error: %v", err)
+	}
+	if _, err := services.CreateLocalCommit(repo, dest, []internal.Commit{{ID: "222", AuthoredDate: base}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	if err := services.PushLocalCommits(repo, dest); err != nil {
+		t.Fatalf("PushLocalCommits returned error: %v", err)
+	}
+
+	pushed, err := remote.Reference(plumbing.NewBranchReferenceName("contributions"), false)
+	if err != nil {
+		t.Fatalf("Expected the contributions branch on the remote: %v", err)
+	}
+	commit, err := remote.CommitObject(pushed.Hash())
+	if err != nil {
+		t.Fatalf("Failed to read pushed commit: %v", err)
+	}
+	if len(commit.ParentHashes) != 0 || !strings.HasPrefix(commit.Message, "222") {
+		t.Errorf("Expected a new branch holding only commit 222, got %q with parents %v", commit.Message, commit.ParentHashes)
+	}
+
+	master, err := remote.Reference(plumbing.NewBranchReferenceName("master"), false)
+	if err != nil || master.Hash() != untouched.Hash() {
+		t.Errorf("Expected master to stay at %s", untouched.Hash())
+	}
+
+	branchConfig, err := repo.Branch("contributions")
+	if err != nil || branchConfig.Remote != "origin" {
+		t.Errorf("Expected contributions to track origin, got %+v (%v)", branchConfig, err)
+	}
+}
+
+func TestPushLocalCommitsReconcilesDivergedRemote(t *testing.T) {
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		strategy      string
+		expectError   bool
+		expectParents int
+	}{
+		{name: "abort", strategy: "", expectError: true},
+		{name: "rebase", strategy: "rebase", expectParents: 1},
+		{name: "merge", strategy: "merge", expectParents: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remotePath := t.TempDir()
+			remote, err := git.PlainInit(remotePath, true)
+			if err != nil {
+				t.Fatalf("Failed to init remote: %v", err)
+			}
+
+			os.Setenv("GH_USERNAME", "github_user")
+			os.Setenv("COMMITER_EMAIL", "user@example.com")
+			os.Setenv("ORIGIN_REPO_URL", remotePath)
+			os.Setenv("DIVERGENCE_STRATEGY", tt.strategy)
+			defer os.Unsetenv("GH_USERNAME")
+			defer os.Unsetenv("COMMITER_EMAIL")
+			defer os.Unsetenv("ORIGIN_REPO_URL")
+			defer os.Unsetenv("DIVERGENCE_STRATEGY")
+
+			if _, err := services.CreateLocalCommit(remote, dest, []internal.Commit{{ID: "111", AuthoredDate: base}}); err != nil {
+				t.Fatalf("CreateLocalCommit returned error: %v", err)
+			}
+			repo, err := services.CloneInMemory(dest)
+			if err != nil {
+				t.Fatalf("CloneInMemory returned error: %v", err)
+			}
+
+			// Someone pushes to the mirror while this run creates its commits.
+			if _, err := services.CreateLocalCommit(remote, dest, []internal.Commit{{ID: "222", AuthoredDate: base.Add(time.Hour)}}); err != nil {
+				t.Fatalf("CreateLocalCommit returned error: %v", err)
+			}
+			if _, err := services.CreateLocalCommit(repo, dest, []internal.Commit{{ID: "333", AuthoredDate: base.Add(2 * time.Hour)}}); err != nil {
+				t.Fatalf("CreateLocalCommit returned error: %v", err)
+			}
+
+			err = services.PushLocalCommits(repo, dest)
+			if tt.expectError {
+				if err == nil || !strings.Contains(err.Error(), "diverged") {
+					t.Errorf("Expected a divergence diagnostic, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PushLocalCommits returned error: %v", err)
+			}
+
+			head, _ := remote.Head()
+			commit, err := remote.CommitObject(head.Hash())
+			if err != nil {
+				t.Fatalf("Failed to read remote head: %v", err)
+			}
+			if len(commit.ParentHashes) != tt.expectParents {
+				t.Errorf("Expected %d parents, got %d", tt.expectParents, len(commit.ParentHashes))
+			}
+
+			subjects := map[string]bool{}
+			iter, _ := remote.Log(&git.LogOptions{From: head.Hash()})
+			iter.ForEach(func(c *object.Commit) error {
+				subject, _, _ := strings.Cut(c.Message, "\n")
+				subjects[subject] = true
+				return nil
+			})
+			for _, id := range []string{"111", "222", "333"} {
+				if !subjects[id] {
+					t.Errorf("Expected commit %s on the remote", id)
+				}
+			}
+		})
+	}
+}
+
+func TestHasUnpushedCommitsAfterReconciling(t *testing.T) {
+	remotePath := t.TempDir()
+	remote, err := git.PlainInit(remotePath, true)
+	if err != nil {
+		t.Fatalf("Failed to init remote: %v", err)
+	}
+
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	os.Setenv("ORIGIN_REPO_URL", remotePath)
+	os.Setenv("DIVERGENCE_STRATEGY", "merge")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+	defer os.Unsetenv("DIVERGENCE_STRATEGY")
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := services.CreateLocalCommit(remote, dest, []internal.Commit{{ID: "111", AuthoredDate: base}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	repo, err := services.CloneInMemory(dest)
+	if err != nil {
+		t.Fatalf("CloneInMemory returned error: %v", err)
+	}
+	if err := services.PullLatestChanges(repo, dest); err != nil {
+		t.Fatalf("PullLatestChanges returned error: %v", err)
+	}
+	if unpushed, err := services.HasUnpushedCommits(repo); err != nil || unpushed {
+		t.Errorf("Expected nothing to push after cloning, got %v, %v", unpushed, err)
+	}
+
+	// A commit left behind by a failed push, then the remote moves on.
+	if _, err := services.CreateLocalCommit(repo, dest, []internal.Commit{{ID: "222", AuthoredDate: base.Add(time.Hour)}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	if _, err := services.CreateLocalCommit(remote, dest, []internal.Commit{{ID: "333", AuthoredDate: base.Add(2 * time.Hour)}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	if err := services.PullLatestChanges(repo, dest); err != nil {
+		t.Fatalf("PullLatestChanges returned error: %v", err)
+	}
+	if unpushed, err := services.HasUnpushedCommits(repo); err != nil || !unpushed {
+		t.Errorf("Expected the merge to need a push, got %v, %v", unpushed, err)
+	}
+
+	if err := services.PushLocalCommits(repo, dest); err != nil {
+		t.Fatalf("PushLocalCommits returned error: %v", err)
+	}
+	if unpushed, err := services.HasUnpushedCommits(repo); err != nil || unpushed {
+		t.Errorf("Expected nothing to push after pushing, got %v, %v", unpushed, err)
+	}
+}
+
+func TestPushLocalCommitsRebaseKeepsRemoteContent(t *testing.T) {
+	remotePath := t.TempDir()
+	remote, err := git.PlainInit(remotePath, true)
+	if err != nil {
+		t.Fatalf("Failed to init remote: %v", err)
+	}
+
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	os.Setenv("ORIGIN_REPO_URL", remotePath)
+	os.Setenv("DIVERGENCE_STRATEGY", "rebase")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+	defer os.Unsetenv("DIVERGENCE_STRATEGY")
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := services.CreateLocalCommit(remote, dest, []internal.Commit{{ID: "111", AuthoredDate: base}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	repo, err := services.CloneInMemory(dest)
+	if err != nil {
+		t.Fatalf("CloneInMemory returned error: %v", err)
+	}
+
+	// Someone adds notes to the mirror while this run creates its commits.
+	notes := commitFile(t, remote, "NOTES.md", "Mirrored from GitLab.\n")
+	if _, err := services.CreateLocalCommit(repo, dest, []internal.Commit{{ID: "222", AuthoredDate: base.Add(time.Hour)}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	if err := services.PushLocalCommits(repo, dest); err != nil {
+		t.Fatalf("PushLocalCommits returned error: %v", err)
+	}
+
+	// Later runs build on the rebased commit and must keep the notes too.
+	if _, err := services.CreateLocalCommit(repo, dest, []internal.Commit{{ID: "333", AuthoredDate: base.Add(2 * time.Hour)}}); err != nil {
+		t.Fatalf("CreateLocalCommit returned error: %v", err)
+	}
+	if err := services.PushLocalCommits(repo, dest); err != nil {
+		t.Fatalf("PushLocalCommits returned error: %v", err)
+	}
+
+	head, _ := remote.Head()
+	commit, err := remote.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatalf("Failed to read remote head: %v", err)
+	}
+	if commit.Message != "333" && !strings.HasPrefix(commit.Message, "333\n") {
+		t.Errorf("Expected commit 333 at the remote head, got %q", commit.Message)
+	}
+	if commit.TreeHash != notes.TreeHash {
+		t.Errorf("Expected the tree with NOTES.md %s, got %s", notes.TreeHash, commit.TreeHash)
+	}
+}
+
+// commitFile commits a file with content on top of the HEAD of repo, the way
+// a person editing the mirror would.
+func commitFile(t *testing.T, repo *git.Repository, name, content string) *object.Commit {
+	t.Helper()
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Failed to read head: %v", err)
+	}
+
+	blob := repo.Storer.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, _ := blob.Writer()
+	w.Write([]byte(content))
+	w.Close()
+	blobHash, err := repo.Storer.SetEncodedObject(blob)
+	if err != nil {
+		t.Fatalf("Failed to store blob: %v", err)
+	}
+
+	parent, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatalf("Failed to read head commit: %v", err)
+	}
+	tree, err := parent.Tree()
+	if err != nil {
+		t.Fatalf("Failed to read tree: %v", err)
+	}
+	entries := append([]object.TreeEntry{{Name: name, Mode: filemode.Regular, Hash: blobHash}}, tree.Entries...)
+	sort.Sort(object.TreeEntrySorter(entries))
+	newTree := &object.Tree{Entries: entries}
+	treeObj := repo.Storer.NewEncodedObject()
+	if err := newTree.Encode(treeObj); err != nil {
+		t.Fatalf("Failed to encode tree: %v", err)
+	}
+	treeHash, err := repo.Storer.SetEncodedObject(treeObj)
+	if err != nil {
+		t.Fatalf("Failed to store tree: %v", err)
+	}
+
+	signature := object.Signature{Name: "someone", Email: "someone@example.com", When: time.Now()}
+	commit := &object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      "Add " + name,
+		TreeHash:     treeHash,
+		ParentHashes: []plumbing.Hash{head.Hash()},
+	}
+	commitObj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(commitObj); err != nil {
+		t.Fatalf("Failed to encode commit: %v", err)
+	}
+	hash, err := repo.Storer.SetEncodedObject(commitObj)
+	if err != nil {
+		t.Fatalf("Failed to store commit: %v", err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), hash)); err != nil {
+		t.Fatalf("Failed to update branch: %v", err)
+	}
+	commit.Hash = hash
+	return commit
+}
+
+func TestCreateLocalCommitUsesDestinationIdentity(t *testing.T) {
+	os.Setenv("GH_USERNAME", "github_user")
+	os.Setenv("COMMITER_EMAIL", "user@example.com")
+	os.Setenv("WORK_GH_USERNAME", "work_user")
+	os.Setenv("WORK_COMMITER_EMAIL", "user@work.example.com")
+	defer os.Unsetenv("GH_USERNAME")
+	defer os.Unsetenv("COMMITER_EMAIL")
+	defer os.Unsetenv("WORK_GH_USERNAME")
+	defer os.Unsetenv("WORK_COMMITER_EMAIL")
+
+	commits := []internal.Commit{{ID: "111", AuthoredDate: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}}
+	expected := map[string]string{"personal": "user@example.com", "work": "user@work.example.com"}
+
+	for name, email := range expected {
+		repo, err := git.Init(memory.NewStorage(), nil)
+		if err != nil {
+			t.Fatalf("Failed to init repository: %v", err)
+		}
+		if _, err := services.CreateLocalCommit(repo, internal.Destination{Name: name}, commits); err != nil {
+			t.Fatalf("CreateLocalCommit returned error: %v", err)
+		}
+
+		head, err := repo.Head()
+		if err != nil {
+			t.Fatalf("Failed to read HEAD: %v", err)
+		}
+		commit, err := repo.CommitObject(head.Hash())
+		if err != nil {
+			t.Fatalf("Failed to read commit: %v", err)
+		}
+		if commit.Author.Email != email {
+			t.Errorf("Expected %s to commit as '%s', got '%s'", name, email, commit.Author.Email)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package services_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestGetAppInstallationToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	tokenRequests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(jwt, ".")
+		if len(parts) != 3 {
+			t.Fatalf("Expected a JWT, got %q", jwt)
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("Invalid JWT signature: %v", err)
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var decoded map[string]any
+		if err := json.Unmarshal(claims, &decoded); err != nil || decoded["iss"] != "42" {
+			t.Errorf("Expected iss claim 42, got %s", claims)
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/user/mirror/installation":
+			fmt.Fprint(w, `{"id":7}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/app/installations/7/access_tokens":
+			tokenRequests++
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token":"ghs_test","expires_at":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockServer.Close()
+
+	os.Setenv("GH_APP_ID", "42")
+	os.Setenv("GH_APP_PRIVATE_KEY", string(keyPEM))
+	os.Setenv("GH_API_URL", mockServer.URL)
+	os.Setenv("ORIGIN_REPO_URL", "https://github.com/user/mirror.git")
+	defer os.Unsetenv("GH_APP_ID")
+	defer os.Unsetenv("GH_APP_PRIVATE_KEY")
+	defer os.Unsetenv("GH_API_URL")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+
+	for i := 0; i < 2; i++ {
+		token, err := services.GetAppInstallationToken(internal.Destination{})
+		if err != nil {
+			t.Fatalf("GetAppInstallationToken returned error: %v", err)
+		}
+		if token != "ghs_test" {
+			t.Errorf("Expected token 'ghs_test', got '%s'", token)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("Expected the token to be cached, got %d token requests", tokenRequests)
+	}
+}
+
+func TestGetAppInstallationTokenOnGitHubEnterprise(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v3/repos/team/mirror/installation":
+			fmt.Fprint(w, `{"id":9}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v3/app/installations/9/access_tokens":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token":"ghs_enterprise","expires_at":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockServer.Close()
+
+	// Without GH_API_URL the API is derived from the enterprise host.
+	os.Setenv("GH_APP_ID", "43")
+	os.Setenv("GH_APP_PRIVATE_KEY", string(keyPEM))
+	os.Setenv("ORIGIN_REPO_URL", mockServer.URL+"/team/mirror.git")
+	defer os.Unsetenv("GH_APP_ID")
+	defer os.Unsetenv("GH_APP_PRIVATE_KEY")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+
+	token, err := services.GetAppInstallationToken(internal.Destination{})
+	if err != nil {
+		t.Fatalf("GetAppInstallationToken returned error: %v", err)
+	}
+	if token != "ghs_enterprise" {
+		t.Errorf("Expected token 'ghs_enterprise', got '%s'", token)
+	}
+}
@@ -96,6 +96,59 @@ func TestGetGitlabUser(t *testing.T) {
 		})
 	}
 }
+func TestGetImportedUser(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/user":
+			fmt.Fprint(w, `{"username":"tokenowner","id":1}`)
+		case "/api/v4/users":
+			if r.URL.Query().Get("username") == "otheruser" {
+				fmt.Fprint(w, `[{"username":"otheruser","id":2}]`)
+			} else {
+				fmt.Fprint(w, `[]`)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockServer.Close()
+
+	os.Setenv("BASE_URL", mockServer.URL)
+	os.Setenv("GITLAB_TOKEN", "token")
+	defer os.Unsetenv("BASE_URL")
+	defer os.Unsetenv("GITLAB_TOKEN")
+	defer os.Unsetenv("GITLAB_USERNAME")
+
+	tests := []struct {
+		username    string
+		expectedID  int
+		expectError bool
+	}{
+		{username: "", expectedID: 1},
+		{username: "TokenOwner", expectedID: 1},
+		{username: "otheruser", expectedID: 2},
+		{username: "missing", expectError: true},
+	}
+
+	for _, tt := range tests {
+		os.Setenv("GITLAB_USERNAME", tt.username)
+		user, err := services.GetImportedUser()
+		if tt.expectError {
+			if err == nil {
+				t.Errorf("Expected an error for GITLAB_USERNAME %q, got user %+v", tt.username, user)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("GetImportedUser returned error for GITLAB_USERNAME %q: %v", tt.username, err)
+			continue
+		}
+		if user.ID != tt.expectedID {
+			t.Errorf("Expected user %d for GITLAB_USERNAME %q, got %d", tt.expectedID, tt.username, user.ID)
+		}
+	}
+}
+
 func TestGetUsersProjectsIds(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -380,3 +433,99 @@ func TestGetProjectsCommits(t *testing.T) {
 		})
 	}
 }
+
+func TestFetchAllCommitsReportsProjects(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/projects/1/repository/commits":
+			json.NewEncoder(w).Encode([]internal.Commit{{ID: "123"}, {ID: "456"}})
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer mockServer.Close()
+
+	os.Setenv("BASE_URL", mockServer.URL)
+	os.Setenv("GITLAB_TOKEN", "test-token")
+	defer os.Unsetenv("BASE_URL")
+	defer os.Unsetenv("GITLAB_TOKEN")
+
+	commitChannel := make(chan []internal.Commit, 2)
+	results := services.FetchAllCommits([]int{1, 2}, "user", commitChannel)
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 project results, got %d", len(results))
+	}
+	if results[0].ProjectID != 1 || results[0].Fetched != 2 || results[0].Error != "" {
+		t.Errorf("Expected 2 commits fetched from project 1, got %+v", results[0])
+	}
+	if results[1].ProjectID != 2 || results[1].Fetched != 0 || !strings.Contains(results[1].Error, "403") {
+		t.Errorf("Expected a 403 error for project 2, got %+v", results[1])
+	}
+}
+
+func TestProjectExists(t *testing.T) {
+	tests := []struct {
+		name         string
+		statusCode   int
+		expectExists bool
+		expectError  bool
+	}{
+		{name: "existing project", statusCode: 200, expectExists: true},
+		{name: "deleted project", statusCode: 404, expectExists: false},
+		{name: "forbidden", statusCode: 403, expectError: true},
+		{name: "server error", statusCode: 500, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v4/projects/42" {
+					t.Errorf("Expected path /api/v4/projects/42, got %s", r.URL.Path)
+				}
+				w.WriteHeader(tt.statusCode)
+				fmt.Fprint(w, `{"id":42}`)
+			}))
+			defer mockServer.Close()
+
+			os.Setenv("BASE_URL", mockServer.URL)
+			defer os.Unsetenv("BASE_URL")
+
+			exists, err := services.ProjectExists(42)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if exists != tt.expectExists {
+				t.Errorf("Expected exists %v, got %v", tt.expectExists, exists)
+			}
+		})
+	}
+}
+
+func TestGetCommit(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/projects/15/repository/commits/b6568db1" {
+			t.Errorf("Expected path /api/v4/projects/15/repository/commits/b6568db1, got %s", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"id":"b6568db1","message":"Update readme","author_name":"Jane Doe","author_email":"jane@example.com","authored_date":"2024-01-14T09:00:00+02:00","committed_date":"2024-01-15T10:00:00+02:00"}`)
+	}))
+	defer mockServer.Close()
+
+	os.Setenv("BASE_URL", mockServer.URL)
+	defer os.Unsetenv("BASE_URL")
+
+	commit, err := services.GetCommit(15, "b6568db1")
+	if err != nil {
+		t.Fatalf("GetCommit returned error: %v", err)
+	}
+	expectedDate := time.Date(2024, 1, 14, 7, 0, 0, 0, time.UTC)
+	if commit.ID != "b6568db1" || !commit.AuthoredDate.Equal(expectedDate) {
+		t.Errorf("Expected commit b6568db1 authored at %v, got %s at %v", expectedDate, commit.ID, commit.AuthoredDate)
+	}
+}
@@ -18,6 +18,10 @@ func clearEnvVars(t *testing.T) {
 		"COMMITER_EMAIL",
 		"ORIGIN_REPO_URL",
 		"ORIGIN_TOKEN",
+		"DESTINATIONS",
+		"PERSONAL_ORIGIN_REPO_URL",
+		"WORK_ORIGIN_REPO_URL",
+		"WORK_ORIGIN_TOKEN",
 	}
 
 	for _, v := range vars {
@@ -60,19 +64,49 @@ func TestCheckEnvVariables(t *testing.T) {
 			expectError: true,
 			errorMsg:    "ORIGIN_REPO_URL",
 		},
+		{
+			name: "ssh remote without token",
+			setupEnv: map[string]string{
+				"BASE_URL":        "http://test-url.com",
+				"GITLAB_TOKEN":    "token123",
+				"GITLAB_USERNAME": "gitlab_user",
+				"GH_USERNAME":     "github_user",
+				"COMMITER_EMAIL":  "test@example.com",
+				"ORIGIN_REPO_URL": "git@github.com:user/repo.git",
+			},
+			expectError: false,
+		},
+		{
+			name: "named destination without token",
+			setupEnv: map[string]string{
+				"BASE_URL":                 "http://test-url.com",
+				"GITLAB_TOKEN":             "token123",
+				"GITLAB_USERNAME":          "gitlab_user",
+				"GH_USERNAME":              "github_user",
+				"COMMITER_EMAIL":           "test@example.com",
+				"ORIGIN_REPO_URL":          "http://repo.com",
+				"ORIGIN_TOKEN":             "origintoken123",
+				"DESTINATIONS":             "personal,work",
+				"PERSONAL_ORIGIN_REPO_URL": "http://repo.com",
+				"WORK_ORIGIN_REPO_URL":     "https://github.example.com/user/repo.git",
+				"WORK_ORIGIN_TOKEN":        "",
+			},
+			expectError: true,
+			errorMsg:    "missing required environment variables: WORK_ORIGIN_TOKEN",
+		},
 		{
 			name: "missing multiple variables",
 			setupEnv: map[string]string{
 				"BASE_URL": "http://test-url.com",
 			},
 			expectError: true,
-			errorMsg:    "GITLAB_TOKEN, GITLAB_USERNAME, GH_USERNAME, COMMITER_EMAIL, ORIGIN_REPO_URL, ORIGIN_TOKEN",
+			errorMsg:    "GITLAB_TOKEN, GH_USERNAME, COMMITER_EMAIL, ORIGIN_REPO_URL, ORIGIN_TOKEN",
 		},
 		{
 			name:        "no variables set",
 			setupEnv:    map[string]string{},
 			expectError: true,
-			errorMsg:    "BASE_URL, GITLAB_TOKEN, GITLAB_USERNAME, GH_USERNAME, COMMITER_EMAIL, ORIGIN_REPO_URL, ORIGIN_TOKEN",
+			errorMsg:    "BASE_URL, GITLAB_TOKEN, GH_USERNAME, COMMITER_EMAIL, ORIGIN_REPO_URL, ORIGIN_TOKEN",
 		},
 	}
 
@@ -100,3 +134,53 @@ func TestCheckEnvVariables(t *testing.T) {
 		})
 	}
 }
+
+func TestGetRepoPath(t *testing.T) {
+	defer os.Unsetenv("WORKDIR")
+	defer os.Unsetenv("ORIGIN_REPO_URL")
+
+	tests := []struct {
+		name     string
+		workDir  string
+		envDir   string
+		repoURL  string
+		expected string
+	}{
+		{
+			name:     "https url",
+			workDir:  "/work",
+			repoURL:  "https://github.com/user/repo.git",
+			expected: "/work/github.com_user_repo",
+		},
+		{
+			name:     "ssh url",
+			workDir:  "/work",
+			repoURL:  "git@github.com:user/repo.git",
+			expected: "/work/github.com_user_repo",
+		},
+		{
+			name:     "flag takes precedence over environment",
+			workDir:  "/flag",
+			envDir:   "/env",
+			repoURL:  "https://gitea.example.com/user/repo.git",
+			expected: "/flag/gitea.example.com_user_repo",
+		},
+		{
+			name:     "environment",
+			envDir:   "/env",
+			repoURL:  "https://github.com/user/repo.git",
+			expected: "/env/github.com_user_repo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("WORKDIR", tt.envDir)
+			os.Setenv("ORIGIN_REPO_URL", tt.repoURL)
+
+			if result := internal.GetRepoPath(internal.Destination{}, tt.workDir); result != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, result)
+			}
+		})
+	}
+}
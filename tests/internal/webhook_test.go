@@ -0,0 +1,107 @@
+package services_test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+const pushHookPayload = `{
+  "object_kind": "push",
+  "event_name": "push",
+  "ref": "refs/heads/main",
+  "project_id": 15,
+  "total_commits_count": 3,
+  "project": {"default_branch": "main"},
+  "commits": [
+    {"id": "b6568db1", "message": "Update readme\n", "timestamp": "2024-01-15T10:00:00+02:00",
+     "author": {"name": "Jane Doe", "email": "jane@example.com"}},
+    {"id": "da156088", "message": "Fix build\n", "timestamp": "2024-01-15T11:00:00+02:00",
+     "author": {"name": "John Smith", "email": "john@example.com"}},
+    {"id": "c5feabde", "message": "Add tests\n", "timestamp": "2024-01-15T12:00:00+02:00",
+     "author": {"name": "jdoe", "email": "jane@users.noreply.example.com"}}
+  ]
+}`
+
+func TestParsePushEvent(t *testing.T) {
+	os.Setenv("BASE_URL", "https://gitlab.example.com")
+	defer os.Unsetenv("BASE_URL")
+
+	event, err := internal.ParsePushEvent([]byte(pushHookPayload))
+	if err != nil {
+		t.Fatalf("ParsePushEvent returned error: %v", err)
+	}
+	if !event.IsDefaultBranchPush() {
+		t.Errorf("Expected a push to the default branch")
+	}
+	if !event.Complete() {
+		t.Errorf("Expected the payload to list every commit")
+	}
+
+	commits := event.CommitsBy("jane")
+	var ids []string
+	for _, commit := range commits {
+		ids = append(ids, commit.ID)
+	}
+	if expected := []string{"b6568db1", "c5feabde"}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected commits %v, got %v", expected, ids)
+	}
+
+	if !commits[0].AuthoredDate.IsZero() {
+		t.Errorf("Expected no authored date from the payload, got %v", commits[0].AuthoredDate)
+	}
+	if commits[0].Instance != "gitlab.example.com" || !reflect.DeepEqual(commits[0].ProjectIDs, []int{15}) {
+		t.Errorf("Expected source gitlab.example.com/15, got %s/%v", commits[0].Instance, commits[0].ProjectIDs)
+	}
+}
+
+func TestPushEventFilters(t *testing.T) {
+	tests := []struct {
+		name          string
+		payload       string
+		defaultBranch bool
+		complete      bool
+	}{
+		{
+			name:          "push to another branch",
+			payload:       `{"object_kind": "push", "ref": "refs/heads/feature", "project": {"default_branch": "main"}}`,
+			defaultBranch: false,
+			complete:      true,
+		},
+		{
+			name:          "system hook push",
+			payload:       `{"event_name": "push", "ref": "refs/heads/main", "project": {"default_branch": "main"}}`,
+			defaultBranch: true,
+			complete:      true,
+		},
+		{
+			name:          "tag push",
+			payload:       `{"object_kind": "tag_push", "ref": "refs/tags/v1.0", "project": {"default_branch": "main"}}`,
+			defaultBranch: false,
+			complete:      true,
+		},
+		{
+			name:          "truncated commit list",
+			payload:       `{"object_kind": "push", "ref": "refs/heads/main", "total_commits_count": 40, "project": {"default_branch": "main"}, "commits": [{"id": "a"}]}`,
+			defaultBranch: true,
+			complete:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := internal.ParsePushEvent([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("ParsePushEvent returned error: %v", err)
+			}
+			if event.IsDefaultBranchPush() != tt.defaultBranch {
+				t.Errorf("Expected IsDefaultBranchPush %v, got %v", tt.defaultBranch, event.IsDefaultBranchPush())
+			}
+			if event.Complete() != tt.complete {
+				t.Errorf("Expected Complete %v, got %v", tt.complete, event.Complete())
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package unit_test
 
 import (
 	"os"
-	"strings"
 	"testing"
 
 	"github.com/furmanp/gitlab-activity-importer/internal"
@@ -55,12 +54,9 @@ func TestEnvironmentVariables(t *testing.T) {
 
 		err := internal.SetupEnv()
 
-		if err == nil {
-			t.Error("Expected error when GITLAB_USERNAME is missing")
-		}
-
-		if !strings.Contains(err.Error(), "GITLAB_USERNAME") {
-			t.Errorf("Expected error to mention GITLAB_USERNAME, got: %v", err)
+		// The username defaults to the owner of GITLAB_TOKEN.
+		if err != nil {
+			t.Errorf("Expected no error when GITLAB_USERNAME is missing, got: %v", err)
 		}
 	})
 }